@@ -0,0 +1,87 @@
+"""
+Checks that concurrent transactions on one shared account don't lose updates.
+
+Rules, tiers and campaigns decide what each purchase earns, so the balance after sending N
+purchases in parallel must have gone up by exactly the pointsEarned of the ones that succeeded.
+The balance is read back with the Consistency-Token of the last purchase, so a replica that
+hasn't caught up yet can't answer it.
+
+The same check runs without a cluster in the Go tests, see TestConcurrentPurchasesAndSpends.
+
+Usage:
+    python concurrency_test.py --staff-email barista@example.com --staff-password secret \
+        --account {accountID} --users {user1ID} {user2ID} --store {storeID} --count 200 --workers 20
+"""
+from concurrent.futures import ThreadPoolExecutor
+import argparse
+import sys
+
+import requests
+
+
+def login(host, email, password):
+    res = requests.post(f'{host}/auth/login', json={"email": email, "password": password})
+    res.raise_for_status()
+    return res.json()["accessToken"]
+
+
+def get_balance(host, headers, account, consistency_token=None):
+    if consistency_token:
+        headers = {**headers, "Consistency-Token": consistency_token}
+    res = requests.get(f'{host}/loyalty-accounts/{account}', headers=headers)
+    res.raise_for_status()
+    return res.json()["Points"]
+
+
+def post_transaction(host, headers, account, user, store, amount):
+    """Returns the points the purchase earned, or None if it failed, and its consistency token."""
+    transaction = {"AccountID": account, "UserID": user, "StoreID": store, "amount": amount}
+    res = requests.post(f'{host}/transactions', json=transaction, headers=headers)
+    token = res.headers.get("Consistency-Token")
+    if res.status_code != 201:
+        return None, token
+    return res.json()["pointsEarned"], token
+
+
+def latest(tokens):
+    """The token of the most recent write, tokens look like region:unixmillis."""
+    tokens = [t for t in tokens if t]
+    return max(tokens, key=lambda t: int(t.rsplit(":", 1)[1]), default=None)
+
+
+if __name__ == "__main__":
+    parser = argparse.ArgumentParser()
+    parser.add_argument("--host", default="http://localhost:8080")
+    parser.add_argument("--staff-email", required=True)
+    parser.add_argument("--staff-password", required=True)
+    parser.add_argument("--account", required=True)
+    parser.add_argument("--users", nargs="+", required=True, help="members of the account to spread purchases over")
+    parser.add_argument("--store", required=True, help="store the purchases are made at")
+    parser.add_argument("--count", type=int, default=200)
+    parser.add_argument("--workers", type=int, default=20)
+    parser.add_argument("--amount", type=float, default=3.70)
+    args = parser.parse_args()
+
+    headers = {"Authorization": f'Bearer {login(args.host, args.staff_email, args.staff_password)}'}
+    before = get_balance(args.host, headers, args.account)
+
+    with ThreadPoolExecutor(max_workers=args.workers) as pool:
+        results = list(pool.map(
+            lambda i: post_transaction(args.host, headers, args.account, args.users[i % len(args.users)], args.store,
+                                       args.amount),
+            range(args.count),
+        ))
+
+    earned = [points for points, _ in results if points is not None]
+    succeeded = len(earned)
+    after = get_balance(args.host, headers, args.account, latest(token for _, token in results))
+    expected = before + sum(earned)
+
+    print(f'{succeeded}/{args.count} transactions succeeded')
+    print(f'balance before: {before}, after: {after}, expected: {expected}')
+
+    if after != expected:
+        print(f'FAIL: {expected - after} points were lost')
+        sys.exit(1)
+
+    print('OK: no lost updates')
@@ -3,28 +3,79 @@ package account
 import (
 	"context"
 	"errors"
+	"loyalty-service/internal/ledger"
 	"loyalty-service/internal/model"
-
-	"strconv"
+	"loyalty-service/pkg/db"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultMemberLimit is how many people can share an account unless configured otherwise.
+const DefaultMemberLimit = 4
+
+// What happens to a member's points when they leave or are removed from an account.
+const (
+	// ExitPointsStay leaves the points with the account, they belong to everyone on it.
+	ExitPointsStay = "stay"
+	// ExitPointsFollow moves the points the member earned, less what they spent, to a new
+	// account of their own. Nothing moves if that comes to zero or less.
+	ExitPointsFollow = "follow"
 )
 
+var (
+	// ErrInsufficientPoints is returned when a change would take an account's balance below zero.
+	ErrInsufficientPoints = ledger.ErrInsufficientPoints
+	// ErrInvalidPoints is returned when adding or subtracting zero or a negative number of points.
+	ErrInvalidPoints = errors.New("points must be positive")
+	// ErrAccountFull is returned when adding someone would take an account over its member limit.
+	ErrAccountFull = errors.New("account has reached its member limit")
+	// ErrAlreadyMember is returned when adding a user who already belongs to an account.
+	ErrAlreadyMember = errors.New("user already belongs to an account")
+	// ErrNotMember is returned when a user isn't a member of the account.
+	ErrNotMember = errors.New("user is not a member of the account")
+	// ErrNotOwner is returned when someone other than the owner tries to manage an account.
+	ErrNotOwner = errors.New("only the account owner can do this")
+	// ErrAccountClosed is returned when changing an account that has been closed.
+	ErrAccountClosed = ledger.ErrAccountClosed
+	// ErrOwnerCannotLeave is returned when the owner tries to leave or be removed from their account.
+	ErrOwnerCannotLeave = errors.New("the owner must transfer ownership or close the account before leaving")
+	// ErrInvitationRequired is returned when someone other than an admin puts other people on a new account.
+	ErrInvitationRequired = errors.New("other people can only join an account by invitation")
+)
+
+// Actor is the user making a change to an account. Admins can manage any account,
+// everyone else has to own it.
+type Actor struct {
+	UserID string
+	Admin  bool
+}
+
 // Service provides methods for account management
 type Service struct {
-	db *gorm.DB
+	db          *gorm.DB
+	ledgerSvc   *ledger.Service
+	memberLimit int
+	exitPolicy  string
 }
 
-// NewService creates a new account service with a MongoDB collection
-func NewService(db *gorm.DB) *Service {
+// NewService creates a new account service allowing up to memberLimit people per account
+// and handling leaving members' points according to exitPolicy
+func NewService(db *gorm.DB, ledgerSvc *ledger.Service, memberLimit int, exitPolicy string) *Service {
 	return &Service{
-		db: db,
+		db:          db,
+		ledgerSvc:   ledgerSvc,
+		memberLimit: memberLimit,
+		exitPolicy:  exitPolicy,
 	}
 }
 
 // CreateAccount adds a new loyalty group account to the database along with associating users and allocating points.
-func (s *Service) CreateAccount(ctx context.Context, account model.Account, userIds []string, points int) (*model.Account, error) {
+// The owner is always a member, whether or not they are listed in userIds. Only admins can put anyone but
+// themselves on the account, everyone else has to invite the others. Every member added is audited.
+func (s *Service) CreateAccount(ctx context.Context, account model.Account, ownerID string, userIds []string, points int, actor Actor) (*model.Account, error) {
 	// Generate a new UUID for the account
 	accountID, err := uuid.NewRandom()
 	if err != nil {
@@ -32,10 +83,24 @@ func (s *Service) CreateAccount(ctx context.Context, account model.Account, user
 	}
 
 	account.ID = accountID.String()
-	account.Points = points // Set initial points for the account
+	account.OwnerID = &ownerID
+	account.Points = 0 // Initial points are posted to the ledger once the account exists
+	account.Region = db.RegionFrom(ctx)
+
+	members := uniqueIDs(append([]string{ownerID}, userIds...))
+	if len(members) > s.memberLimit {
+		return nil, ErrAccountFull
+	}
+	if !actor.Admin {
+		for _, userID := range members {
+			if userID != actor.UserID {
+				return nil, ErrInvitationRequired
+			}
+		}
+	}
 
 	// Begin a transaction
-	tx := s.db.Begin()
+	tx := s.db.WithContext(ctx).Begin()
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -47,22 +112,47 @@ func (s *Service) CreateAccount(ctx context.Context, account model.Account, user
 	}
 
 	// Associate users with the account and update their points
-	for _, userID := range userIds {
+	for _, userID := range members {
 		var user model.User
-		// Find the user by their ID
-		if err := tx.WithContext(ctx).Where("user_uuid = ?", userID).First(&user).Error; err != nil {
+		// Lock the user so they can't join another account in the meantime
+		err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_uuid = ?", userID).First(&user).Error
+		if err != nil {
 			tx.Rollback() // Roll back the transaction on error
 			return nil, err
 		}
 
-		// Associate the user with the account
-		user.AccountID = &account.ID
+		// Users have to leave their current account before joining another
+		if user.AccountID != nil {
+			tx.Rollback()
+			return nil, ErrAlreadyMember
+		}
 
-		// Update the user's record in the database
-		if err := tx.WithContext(ctx).Save(&user).Error; err != nil {
+		// Only the account changes, a role or store set meanwhile must not be overwritten
+		if err := tx.WithContext(ctx).Model(&user).Update("account_uuid", account.ID).Error; err != nil {
 			tx.Rollback() // Roll back the transaction on error
 			return nil, err
 		}
+
+		err = s.RecordAudit(tx.WithContext(ctx), &model.AuditEntry{
+			AccountID: account.ID,
+			ActorID:   &actor.UserID,
+			UserID:    &user.ID,
+			Action:    model.AuditMemberJoined,
+			Detail:    "added when the account was created",
+		})
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if points != 0 {
+		err := s.ledgerSvc.Post(tx.WithContext(ctx), model.LedgerAdjustment, account.ID, points, nil, "initial points")
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		account.Points = points
 	}
 
 	// Commit the transaction
@@ -85,134 +175,417 @@ func (s *Service) GetAccount(ctx context.Context, accountID string) (*model.Acco
 	return &account, nil
 }
 
-// AddPoints increments points for a user's account based on the transaction amount
-func (s *Service) AddPoints(ctx context.Context, userID string, points int) error {
-	// Convert the userID string to Int
-	userIDInt, err := strconv.Atoi(userID)
+// LastWrite returns when an account's balance, history or members last changed, the zero time if
+// they never have. It is read from a primary unless ctx allows replica reads.
+func (s *Service) LastWrite(ctx context.Context, accountID string) (time.Time, error) {
+	var account model.Account
+	err := s.db.WithContext(ctx).Select("last_write_date").First(&account, "account_uuid = ?", accountID).Error
+	if err != nil || account.LastWriteDate == nil {
+		return time.Time{}, err
+	}
+
+	return *account.LastWriteDate, nil
+}
+
+// ReserveSeats checks that seats more people can join an account. It must be called inside the
+// transaction that adds them: the account row stays locked until that transaction ends, so
+// concurrent invitations and joins are counted one after the other.
+//
+// Pending invitations hold a seat until they expire. When someone accepts an invitation,
+// pass its ID so it isn't counted on top of the member it turns into.
+func (s *Service) ReserveSeats(tx *gorm.DB, accountID string, seats int, acceptingInvitationID string) error {
+	var account model.Account
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_uuid = ?", accountID).Error
 	if err != nil {
-		// Handle invalid userID format
 		return err
 	}
 
-	// Begin transaction
-	tx := s.db.WithContext(ctx).Begin()
-	if tx.Error != nil {
-		return tx.Error
+	if account.ClosedDate != nil {
+		return ErrAccountClosed
 	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			panic(r)
-		} else if tx.Error != nil {
-			tx.Rollback()
-		}
-	}()
 
-	// Check if the user exists
-	var user model.User
-	if err := tx.First(&user, "id = ?", userIDInt).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
-		}
+	var members int64
+	if err := tx.Model(&model.User{}).Where("account_uuid = ?", accountID).Count(&members).Error; err != nil {
 		return err
 	}
 
-	// Update points
-	user.Account.Points += points
-	if err := tx.Save(&user).Error; err != nil {
+	var pending int64
+	err = tx.Model(&model.Invitation{}).
+		Where("account_uuid = ? AND status = ? AND expiration_date > ? AND invitation_uuid <> ?",
+			accountID, "pending", time.Now(), acceptingInvitationID).
+		Count(&pending).Error
+	if err != nil {
 		return err
 	}
 
-	// Commit transaction
-	return tx.Commit().Error
+	if int(members+pending)+seats > s.memberLimit {
+		return ErrAccountFull
+	}
+
+	return nil
 }
 
-// SubtractPoints subtracts points from a user's loyalty account
-func (s *Service) SubtractPoints(ctx context.Context, userID string, pointsToSubtract int) error {
-	if pointsToSubtract <= 0 {
-		return errors.New("points to subtract must be positive")
-	}
+// TransferOwnership hands an account over to another of its members.
+func (s *Service) TransferOwnership(ctx context.Context, accountID string, actor Actor, newOwnerID string) (*model.Account, error) {
+	var account model.Account
 
-	// Convert the userID string to Int
-	userIDInt, err := strconv.Atoi(userID)
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := s.lockOwnedAccount(tx, &account, accountID, actor); err != nil {
+			return err
+		}
+
+		var members int64
+		err := tx.Model(&model.User{}).Where("user_uuid = ? AND account_uuid = ?", newOwnerID, accountID).Count(&members).Error
+		if err != nil {
+			return err
+		}
+		if members == 0 {
+			return ErrNotMember
+		}
+
+		if err := tx.Model(&account).Update("owner_id", newOwnerID).Error; err != nil {
+			return err
+		}
+
+		account.OwnerID = &newOwnerID
+		return s.RecordAudit(tx, &model.AuditEntry{
+			AccountID: accountID,
+			ActorID:   &actor.UserID,
+			UserID:    &newOwnerID,
+			Action:    model.AuditOwnershipTransferred,
+		})
+	})
 	if err != nil {
-		// Handle invalid userID format
-		return err
+		return nil, err
 	}
 
-	// Begin transaction
-	tx := s.db.WithContext(ctx).Begin()
-	if tx.Error != nil {
-		return tx.Error
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			panic(r)
-		} else if tx.Error != nil {
-			tx.Rollback()
+	return &account, nil
+}
+
+// CloseAccount closes an account for good: every member is removed, pending invitations are
+// cancelled and the remaining points are forfeited.
+func (s *Service) CloseAccount(ctx context.Context, accountID string, actor Actor) (*model.Account, error) {
+	var account model.Account
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := s.lockOwnedAccount(tx, &account, accountID, actor); err != nil {
+			return err
 		}
-	}()
 
-	// Check if the user exists
-	var user model.User
-	if err := tx.First(&user, "id = ?", userIDInt).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
+		err := tx.Model(&model.User{}).Where("account_uuid = ?", accountID).Update("account_uuid", nil).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&model.Invitation{}).Where("account_uuid = ? AND status = ?", accountID, "pending").
+			Update("status", "cancelled").Error
+		if err != nil {
+			return err
 		}
-		return err
-	}
 
-	// Check if the user has enough points
-	if user.Account.Points < pointsToSubtract {
-		// Update points
-		user.Account.Points += pointsToSubtract
-		if err := tx.Save(&user).Error; err != nil {
+		// Forfeit the remaining points before closing, a closed account's balance can't change
+		forfeited := account.Points
+		if forfeited != 0 {
+			err = s.ledgerSvc.Post(tx, model.LedgerExpiry, accountID, -forfeited, nil, "forfeited when the account was closed")
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		if err := tx.Model(&account).Update("closed_date", now).Error; err != nil {
 			return err
 		}
-	} else {
-		return errors.New("insufficient points to subtract")
+
+		account.ClosedDate = &now
+		account.Points = 0
+		return s.RecordAudit(tx, &model.AuditEntry{
+			AccountID: accountID,
+			ActorID:   &actor.UserID,
+			Action:    model.AuditAccountClosed,
+			Points:    forfeited,
+			Detail:    "remaining points forfeited",
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Commit transaction
-	return tx.Commit().Error
+	return &account, nil
 }
 
-// AddUserToAccount adds a user to an account by updating the Account model
-func (s *Service) AddUserToAccount(ctx context.Context, userID, accountID string) error {
-	// Convert userID and accountID to int
-	userIDInt, err := strconv.Atoi(userID)
+// RemoveMember takes a member off an account. The owner can't be removed.
+func (s *Service) RemoveMember(ctx context.Context, accountID, userID string, actor Actor) (*model.AuditEntry, error) {
+	var entry *model.AuditEntry
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var account model.Account
+		if err := s.lockOwnedAccount(tx, &account, accountID, actor); err != nil {
+			return err
+		}
+
+		var err error
+		entry, err = s.removeMember(tx, &account, userID, actor.UserID, model.AuditMemberRemoved)
+		return err
+	})
 	if err != nil {
-		return errors.New("invalid user ID format")
+		return nil, err
 	}
 
-	accountIDInt, err := strconv.Atoi(accountID)
+	return entry, nil
+}
+
+// LeaveAccount takes a user off whichever account they are on. The owner can't leave.
+func (s *Service) LeaveAccount(ctx context.Context, userID string) (*model.AuditEntry, error) {
+	var entry *model.AuditEntry
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user model.User
+		if err := tx.First(&user, "user_uuid = ?", userID).Error; err != nil {
+			return err
+		}
+		if user.AccountID == nil {
+			return ErrNotMember
+		}
+
+		var account model.Account
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_uuid = ?", *user.AccountID).Error
+		if err != nil {
+			return err
+		}
+
+		entry, err = s.removeMember(tx, &account, userID, userID, model.AuditMemberLeft)
+		return err
+	})
 	if err != nil {
-		return errors.New("invalid account ID format")
+		return nil, err
 	}
 
-	// Find the account
-	var account model.Account
-	if err := s.db.First(&account, "id = ?", accountIDInt).Error; err != nil {
+	return entry, nil
+}
+
+// removeMember does the work of leaving and removing. The account must already be locked.
+func (s *Service) removeMember(tx *gorm.DB, account *model.Account, userID, actorID, action string) (*model.AuditEntry, error) {
+	var member model.User
+	err := tx.First(&member, "user_uuid = ? AND account_uuid = ?", userID, account.ID).Error
+	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("account not found")
+			return nil, ErrNotMember
 		}
-		return err
+		return nil, err
 	}
 
-	// Find the user
-	var user model.User
-	if err := s.db.First(&user, "id = ?", userIDInt).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
+	if account.OwnerID != nil && *account.OwnerID == userID {
+		return nil, ErrOwnerCannotLeave
+	}
+
+	entry := model.AuditEntry{
+		AccountID: account.ID,
+		ActorID:   &actorID,
+		UserID:    &userID,
+		Action:    action,
+		Detail:    "points stay with the account",
+	}
+
+	var newAccountID *string
+
+	if s.exitPolicy == ExitPointsFollow {
+		// What the member brought in through their own purchases, less what they spent
+		var earned int
+		err := tx.Model(&model.Transaction{}).Select("COALESCE(SUM(points_earned), 0)").
+			Where("account_uuid = ? AND user_uuid = ?", account.ID, userID).Scan(&earned).Error
+		if err != nil {
+			return nil, err
+		}
+
+		if earned > account.Points {
+			earned = account.Points
 		}
+
+		if earned > 0 {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return nil, err
+			}
+
+			// The new account stays in the region the member's data already lives in
+			personal := model.Account{
+				ID:      id.String(),
+				OwnerID: &userID,
+				Region:  account.Region,
+			}
+			if err := tx.Create(&personal).Error; err != nil {
+				return nil, err
+			}
+
+			err = s.ledgerSvc.Transfer(tx, account.ID, personal.ID, earned, userID+" left the account")
+			if err != nil {
+				return nil, err
+			}
+
+			account.Points -= earned
+			newAccountID = &personal.ID
+			entry.Points = earned
+			entry.Detail = "points moved to account " + personal.ID
+		}
+	}
+
+	if err := tx.Model(&member).Update("account_uuid", newAccountID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.RecordAudit(tx, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// GetAuditLog lists the membership changes made to an account, newest first.
+func (s *Service) GetAuditLog(ctx context.Context, accountID string) ([]model.AuditEntry, error) {
+	var entries []model.AuditEntry
+	err := s.db.WithContext(ctx).Where("account_uuid = ?", accountID).Order("creation_date DESC").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// RecordAudit writes an entry to the account audit log as part of the transaction tx.
+func (s *Service) RecordAudit(tx *gorm.DB, entry *model.AuditEntry) error {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	entry.ID = id.String()
+	entry.CreationDate = time.Now()
+
+	if err := tx.Create(entry).Error; err != nil {
 		return err
 	}
 
-	// Add user to account
-	if err := s.db.Model(&account).Association("Users").Append(&user); err != nil {
+	return s.ledgerSvc.Touch(tx, entry.AccountID)
+}
+
+// lockOwnedAccount loads and locks an open account, checking that the actor may manage it.
+func (s *Service) lockOwnedAccount(tx *gorm.DB, account *model.Account, accountID string, actor Actor) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(account, "account_uuid = ?", accountID).Error
+	if err != nil {
 		return err
 	}
 
+	if account.ClosedDate != nil {
+		return ErrAccountClosed
+	}
+
+	if !actor.Admin && (account.OwnerID == nil || *account.OwnerID != actor.UserID) {
+		return ErrNotOwner
+	}
+
 	return nil
 }
+
+// AddUserToAccount puts a user who isn't on an account yet straight onto this one, without an invitation.
+func (s *Service) AddUserToAccount(ctx context.Context, accountID, userID string, actor Actor) (*model.AuditEntry, error) {
+	entry := model.AuditEntry{
+		AccountID: accountID,
+		ActorID:   &actor.UserID,
+		UserID:    &userID,
+		Action:    model.AuditMemberJoined,
+		Detail:    "added to the account",
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var account model.Account
+		if err := s.lockOwnedAccount(tx, &account, accountID, actor); err != nil {
+			return err
+		}
+
+		if err := s.ReserveSeats(tx, accountID, 1, ""); err != nil {
+			return err
+		}
+
+		var user model.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "user_uuid = ?", userID).Error; err != nil {
+			return err
+		}
+
+		// Users have to leave their current account before joining another
+		if user.AccountID != nil {
+			return ErrAlreadyMember
+		}
+
+		if err := tx.Model(&user).Update("account_uuid", accountID).Error; err != nil {
+			return err
+		}
+
+		return s.RecordAudit(tx, &entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// AddPoints credits points to an account.
+func (s *Service) AddPoints(ctx context.Context, accountID string, points int) (*model.Account, error) {
+	if points <= 0 {
+		return nil, ErrInvalidPoints
+	}
+
+	return s.changeBalance(ctx, accountID, points)
+}
+
+// SubtractPoints debits points from an account, failing with ErrInsufficientPoints
+// rather than taking the balance below zero.
+func (s *Service) SubtractPoints(ctx context.Context, accountID string, points int) (*model.Account, error) {
+	if points <= 0 {
+		return nil, ErrInvalidPoints
+	}
+
+	return s.changeBalance(ctx, accountID, -points)
+}
+
+// AdjustPoints applies a manual correction to an account's balance. Positive values add points,
+// negative values remove them; the balance can never go below zero.
+func (s *Service) AdjustPoints(ctx context.Context, accountID string, delta int) (*model.Account, error) {
+	if delta < 0 {
+		return s.SubtractPoints(ctx, accountID, -delta)
+	}
+
+	return s.AddPoints(ctx, accountID, delta)
+}
+
+// changeBalance posts a manual adjustment of delta and returns the account as it is afterwards.
+func (s *Service) changeBalance(ctx context.Context, accountID string, delta int) (*model.Account, error) {
+	var account model.Account
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := s.ledgerSvc.Post(tx, model.LedgerAdjustment, accountID, delta, nil, "manual adjustment"); err != nil {
+			return err
+		}
+
+		return tx.First(&account, "account_uuid = ?", accountID).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// uniqueIDs drops repeated IDs, keeping the first occurrence.
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	var unique []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
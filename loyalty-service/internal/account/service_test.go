@@ -0,0 +1,349 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/testdb"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func newService(t *testing.T) (*Service, *gorm.DB) {
+	db := testdb.Open(t)
+	return NewService(db, ledger.NewService(db), DefaultMemberLimit, ExitPointsStay), db
+}
+
+// seedAccount creates an open account owned by ownerID with the given balance posted to the ledger.
+func seedAccount(t *testing.T, s *Service, db *gorm.DB, id, ownerID string, points int) {
+	t.Helper()
+
+	seedUser(t, db, ownerID, &id)
+	if err := db.Create(&model.Account{ID: id, OwnerID: &ownerID}).Error; err != nil {
+		t.Fatalf("creating account: %v", err)
+	}
+	if points > 0 {
+		if _, err := s.AddPoints(context.Background(), id, points); err != nil {
+			t.Fatalf("seeding points: %v", err)
+		}
+	}
+}
+
+func seedUser(t *testing.T, db *gorm.DB, id string, accountID *string) {
+	t.Helper()
+
+	user := model.User{ID: id, AccountID: accountID, Name: id, Email: id + "@example.com", Role: model.RoleCustomer}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+}
+
+func closeAccount(t *testing.T, db *gorm.DB, id string) {
+	t.Helper()
+
+	if err := db.Model(&model.Account{}).Where("account_uuid = ?", id).Update("closed_date", time.Now()).Error; err != nil {
+		t.Fatalf("closing account: %v", err)
+	}
+}
+
+// assertBalance checks both the cached balance and the account's ledger.
+func assertBalance(t *testing.T, s *Service, id string, want int) {
+	t.Helper()
+
+	account, err := s.GetAccount(context.Background(), id)
+	if err != nil {
+		t.Fatalf("loading account: %v", err)
+	}
+	if account.Points != want {
+		t.Errorf("cached balance = %d, want %d", account.Points, want)
+	}
+
+	balance, err := s.ledgerSvc.Balance(context.Background(), id)
+	if err != nil {
+		t.Fatalf("loading ledger balance: %v", err)
+	}
+	if balance != want {
+		t.Errorf("ledger balance = %d, want %d", balance, want)
+	}
+}
+
+func TestAddPoints(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	seedAccount(t, s, db, "acc", "owner", 0)
+	seedAccount(t, s, db, "closed", "closer", 0)
+	closeAccount(t, db, "closed")
+
+	account, err := s.AddPoints(ctx, "acc", 25)
+	if err != nil {
+		t.Fatalf("AddPoints: %v", err)
+	}
+	if account.Points != 25 {
+		t.Errorf("returned balance = %d, want 25", account.Points)
+	}
+	assertBalance(t, s, "acc", 25)
+
+	tests := []struct {
+		name      string
+		accountID string
+		points    int
+		want      error
+	}{
+		{"zero", "acc", 0, ErrInvalidPoints},
+		{"negative", "acc", -5, ErrInvalidPoints},
+		{"closed account", "closed", 5, ErrAccountClosed},
+		{"missing account", "missing", 5, gorm.ErrRecordNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.AddPoints(ctx, tt.accountID, tt.points); !errors.Is(err, tt.want) {
+				t.Errorf("AddPoints = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	assertBalance(t, s, "acc", 25)
+	assertBalance(t, s, "closed", 0)
+}
+
+func TestSubtractPoints(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	seedAccount(t, s, db, "acc", "owner", 30)
+	seedAccount(t, s, db, "closed", "closer", 10)
+	closeAccount(t, db, "closed")
+
+	account, err := s.SubtractPoints(ctx, "acc", 20)
+	if err != nil {
+		t.Fatalf("SubtractPoints: %v", err)
+	}
+	if account.Points != 10 {
+		t.Errorf("returned balance = %d, want 10", account.Points)
+	}
+
+	tests := []struct {
+		name      string
+		accountID string
+		points    int
+		want      error
+	}{
+		{"more than the balance", "acc", 11, ErrInsufficientPoints},
+		{"zero", "acc", 0, ErrInvalidPoints},
+		{"negative", "acc", -1, ErrInvalidPoints},
+		{"closed account", "closed", 1, ErrAccountClosed},
+		{"missing account", "missing", 1, gorm.ErrRecordNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.SubtractPoints(ctx, tt.accountID, tt.points); !errors.Is(err, tt.want) {
+				t.Errorf("SubtractPoints = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	assertBalance(t, s, "acc", 10)
+
+	// The whole balance can be spent
+	if _, err := s.SubtractPoints(ctx, "acc", 10); err != nil {
+		t.Fatalf("SubtractPoints of the whole balance: %v", err)
+	}
+	assertBalance(t, s, "acc", 0)
+}
+
+func TestAdjustPoints(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	seedAccount(t, s, db, "acc", "owner", 10)
+	seedAccount(t, s, db, "closed", "closer", 0)
+	closeAccount(t, db, "closed")
+
+	if _, err := s.AdjustPoints(ctx, "acc", 15); err != nil {
+		t.Fatalf("AdjustPoints(+15): %v", err)
+	}
+	assertBalance(t, s, "acc", 25)
+
+	if _, err := s.AdjustPoints(ctx, "acc", -5); err != nil {
+		t.Fatalf("AdjustPoints(-5): %v", err)
+	}
+	assertBalance(t, s, "acc", 20)
+
+	tests := []struct {
+		name      string
+		accountID string
+		delta     int
+		want      error
+	}{
+		{"below zero", "acc", -21, ErrInsufficientPoints},
+		{"zero", "acc", 0, ErrInvalidPoints},
+		{"closed account", "closed", 5, ErrAccountClosed},
+		{"missing account", "missing", -5, gorm.ErrRecordNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.AdjustPoints(ctx, tt.accountID, tt.delta); !errors.Is(err, tt.want) {
+				t.Errorf("AdjustPoints = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	assertBalance(t, s, "acc", 20)
+}
+
+func TestAddUserToAccount(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	seedAccount(t, s, db, "acc", "owner", 0)
+	seedAccount(t, s, db, "other", "other-owner", 0)
+	seedAccount(t, s, db, "closed", "closer", 0)
+	closeAccount(t, db, "closed")
+	seedUser(t, db, "newcomer", nil)
+	seedUser(t, db, "stranger", nil)
+
+	owner := Actor{UserID: "owner"}
+
+	entry, err := s.AddUserToAccount(ctx, "acc", "newcomer", owner)
+	if err != nil {
+		t.Fatalf("AddUserToAccount: %v", err)
+	}
+	if entry.Action != model.AuditMemberJoined || *entry.UserID != "newcomer" || *entry.ActorID != "owner" {
+		t.Errorf("audit entry = %+v, want newcomer joining, added by the owner", entry)
+	}
+
+	var user model.User
+	if err := db.First(&user, "user_uuid = ?", "newcomer").Error; err != nil {
+		t.Fatalf("loading user: %v", err)
+	}
+	if user.AccountID == nil || *user.AccountID != "acc" {
+		t.Errorf("user's account = %v, want acc", user.AccountID)
+	}
+
+	var audited int64
+	db.Model(&model.AuditEntry{}).Where("account_uuid = ? AND user_uuid = ?", "acc", "newcomer").Count(&audited)
+	if audited != 1 {
+		t.Errorf("%d audit entries, want 1", audited)
+	}
+
+	tests := []struct {
+		name      string
+		accountID string
+		userID    string
+		actor     Actor
+		want      error
+	}{
+		{"already on this account", "acc", "newcomer", owner, ErrAlreadyMember},
+		{"on another account", "acc", "other-owner", owner, ErrAlreadyMember},
+		{"not the owner", "acc", "stranger", Actor{UserID: "newcomer"}, ErrNotOwner},
+		{"closed account", "closed", "stranger", Actor{UserID: "closer"}, ErrAccountClosed},
+		{"missing account", "missing", "stranger", Actor{UserID: "owner", Admin: true}, gorm.ErrRecordNotFound},
+		{"missing user", "acc", "nobody", owner, gorm.ErrRecordNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.AddUserToAccount(ctx, tt.accountID, tt.userID, tt.actor); !errors.Is(err, tt.want) {
+				t.Errorf("AddUserToAccount = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Admins can add people to anyone's account
+	if _, err := s.AddUserToAccount(ctx, "acc", "stranger", Actor{UserID: "admin", Admin: true}); err != nil {
+		t.Fatalf("AddUserToAccount by an admin: %v", err)
+	}
+}
+
+func TestAddUserToAccountMemberLimit(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	seedAccount(t, s, db, "acc", "owner", 0)
+	owner := Actor{UserID: "owner"}
+
+	// The owner takes the first seat
+	for _, id := range []string{"a", "b", "c"} {
+		seedUser(t, db, id, nil)
+		if _, err := s.AddUserToAccount(ctx, "acc", id, owner); err != nil {
+			t.Fatalf("AddUserToAccount(%s): %v", id, err)
+		}
+	}
+
+	seedUser(t, db, "d", nil)
+	if _, err := s.AddUserToAccount(ctx, "acc", "d", owner); !errors.Is(err, ErrAccountFull) {
+		t.Errorf("AddUserToAccount over the limit = %v, want %v", err, ErrAccountFull)
+	}
+
+	// Pending invitations hold seats too
+	s.memberLimit = 5
+	invitation := model.Invitation{
+		InvitationUUID: "inv", Email: "e@example.com", AccountUUID: "acc", InviterUUID: "owner", Token: "token",
+		CreationDate: time.Now(), ExpirationDate: time.Now().Add(time.Hour), Status: "pending",
+	}
+	if err := db.Create(&invitation).Error; err != nil {
+		t.Fatalf("creating invitation: %v", err)
+	}
+	if _, err := s.AddUserToAccount(ctx, "acc", "d", owner); !errors.Is(err, ErrAccountFull) {
+		t.Errorf("AddUserToAccount with a seat held by an invitation = %v, want %v", err, ErrAccountFull)
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	for _, id := range []string{"owner", "friend", "admin"} {
+		seedUser(t, db, id, nil)
+	}
+
+	_, err := s.CreateAccount(ctx, model.Account{}, "owner", []string{"friend"}, 0, Actor{UserID: "owner"})
+	if !errors.Is(err, ErrInvitationRequired) {
+		t.Errorf("CreateAccount with someone else by a customer = %v, want %v", err, ErrInvitationRequired)
+	}
+
+	account, err := s.CreateAccount(ctx, model.Account{}, "owner", []string{"friend"}, 50, Actor{UserID: "admin", Admin: true})
+	if err != nil {
+		t.Fatalf("CreateAccount by an admin: %v", err)
+	}
+	assertBalance(t, s, account.ID, 50)
+
+	var audited int64
+	db.Model(&model.AuditEntry{}).Where("account_uuid = ? AND action = ?", account.ID, model.AuditMemberJoined).Count(&audited)
+	if audited != 2 {
+		t.Errorf("%d members audited, want 2", audited)
+	}
+}
+
+func TestLastWrite(t *testing.T) {
+	s, db := newService(t)
+	ctx := context.Background()
+	seedAccount(t, s, db, "acc", "owner", 0)
+	seedUser(t, db, "newcomer", nil)
+
+	if at, err := s.LastWrite(ctx, "acc"); err != nil || !at.IsZero() {
+		t.Fatalf("LastWrite of an untouched account = %v, %v, want the zero time", at, err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	if _, err := s.AddPoints(ctx, "acc", 10); err != nil {
+		t.Fatalf("AddPoints: %v", err)
+	}
+	earned, err := s.LastWrite(ctx, "acc")
+	if err != nil {
+		t.Fatalf("LastWrite: %v", err)
+	}
+	if earned.Before(before) {
+		t.Errorf("LastWrite after adding points = %v, want after %v", earned, before)
+	}
+
+	// Membership changes count too
+	if _, err := s.AddUserToAccount(ctx, "acc", "newcomer", Actor{UserID: "owner"}); err != nil {
+		t.Fatalf("AddUserToAccount: %v", err)
+	}
+	joined, err := s.LastWrite(ctx, "acc")
+	if err != nil {
+		t.Fatalf("LastWrite: %v", err)
+	}
+	if joined.Before(earned) {
+		t.Errorf("LastWrite after a member joined = %v, want no earlier than %v", joined, earned)
+	}
+
+	if _, err := s.LastWrite(ctx, "missing"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("LastWrite of a missing account = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
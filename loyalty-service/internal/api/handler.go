@@ -1,58 +1,216 @@
 package api
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"loyalty-service/internal/account"
+	"loyalty-service/internal/auth"
+	"loyalty-service/internal/campaign"
+	"loyalty-service/internal/expiry"
+	"loyalty-service/internal/idempotency"
 	"loyalty-service/internal/invitation"
+	"loyalty-service/internal/ledger"
 	"loyalty-service/internal/transaction"
 	"loyalty-service/internal/user"
 
 	"loyalty-service/internal/model"
+	"loyalty-service/internal/reward"
+	"loyalty-service/internal/rules"
+	"loyalty-service/internal/store"
+	"loyalty-service/internal/terminal"
+	"loyalty-service/internal/tier"
+	"loyalty-service/pkg/db"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // Handler struct centralizes dependencies for HTTP handlers.
 type Handler struct {
+	authService        *auth.Service
 	userService        *user.Service
 	transactionService *transaction.Service
 	accountService     *account.Service
 	invitationService  *invitation.Service
+	terminalService    *terminal.Service
+	idempotencyService *idempotency.Service
+	ledgerService      *ledger.Service
+	rulesService       *rules.Service
+	rewardService      *reward.Service
+	expiryService      *expiry.Service
+	tierService        *tier.Service
+	campaignService    *campaign.Service
+	storeService       *store.Service
+	regions            *db.Regions
 }
 
 // NewHandler is the constructor for Handler.
-func NewHandler(userSvc *user.Service, transactionSvc *transaction.Service, accountSvc *account.Service, invitationSvc *invitation.Service) *Handler {
+func NewHandler(authSvc *auth.Service, userSvc *user.Service, transactionSvc *transaction.Service, accountSvc *account.Service, invitationSvc *invitation.Service, terminalSvc *terminal.Service, idempotencySvc *idempotency.Service, ledgerSvc *ledger.Service, rulesSvc *rules.Service, rewardSvc *reward.Service, expirySvc *expiry.Service, tierSvc *tier.Service, campaignSvc *campaign.Service, storeSvc *store.Service, regions *db.Regions) *Handler {
 	return &Handler{
+		authService:        authSvc,
 		userService:        userSvc,
 		transactionService: transactionSvc,
 		accountService:     accountSvc,
 		invitationService:  invitationSvc,
+		terminalService:    terminalSvc,
+		idempotencyService: idempotencySvc,
+		ledgerService:      ledgerSvc,
+		rulesService:       rulesSvc,
+		rewardService:      rewardSvc,
+		expiryService:      expirySvc,
+		tierService:        tierSvc,
+		campaignService:    campaignSvc,
+		storeService:       storeSvc,
+		regions:            regions,
 	}
 }
 
 // SetupRoutes defines all application's routes.
 func (h *Handler) SetupRoutes(router *gin.Engine) {
-	// User account management
+	// Authentication
+	router.POST("/auth/login", h.Login)          // Exchange email and password for session tokens
+	router.POST("/auth/refresh", h.RefreshToken) // Exchange a refresh token for a new token pair
+
+	// User registration is the only user route that doesn't need a session
 	router.POST("/users", h.RegisterUser) // Register a new user
-	router.GET("/users/:id", h.GetUser)   // Retrieve user details
-	// router.PUT("/users/:id", h.UpdateUser) // Update user details
+
+	// Transactions are recorded by store staff or signed by a point-of-sale terminal,
+	// tills can send an Idempotency-Key so retrying after a timeout doesn't record the purchase twice
+	tills := router.Group("/", h.RequireTerminalOrAuth(),
+		RequireRole(model.RoleStoreStaff, model.RoleStoreManager, model.RoleTerminal), h.InHomeRegion(), h.ReadYourWrites(), h.Idempotent())
+	tills.POST("/transactions", h.ProcessTransaction)           // Log a new transaction
+	tills.POST("/transactions/:id/refund", h.RefundTransaction) // Refund some or all of a purchase
+	tills.POST("/transactions/:id/void", h.VoidTransaction)     // Cancel a purchase made moments ago
+
+	// Everything below requires a valid access token, and runs in the region of the data it is about.
+	// Reads may be answered by that region's replicas, see ReadYourWrites
+	authorized := router.Group("/", h.RequireAuth(), h.InHomeRegion(), h.ReadYourWrites())
+	admins := authorized.Group("/", RequireRole(model.RoleAdmin))
+	storeAdmins := authorized.Group("/", RequireRole(model.RoleAdmin, model.RoleStoreManager))
+
+	// User account management
+	authorized.GET("/users/:id", h.GetUser)                     // Retrieve user details
+	authorized.PATCH("/users/:id", h.UpdateUser)                // Update user details
+	storeAdmins.PUT("/users/:id/role", h.SetUserRole)           // Change a user's role
+	authorized.POST("/users/:id/leave-account", h.LeaveAccount) // Leave the user's shared account
 
 	// Managing loyalty-card accounts (Linking family and friends)
-	router.POST("/loyalty-accounts", h.CreateLoyaltyAccount) // Create a new loyalty account
-	// router.PUT("/loyalty-accounts/:id", h.AddUserToLoyaltyAccount)  // Add a user to an existing loyalty account
-	router.GET("/loyalty-accounts/:id", h.GetLoyaltyAccountDetails) // Get details of a loyalty account
+	authorized.POST("/loyalty-accounts", h.CreateLoyaltyAccount)                            // Create a new loyalty account
+	admins.PUT("/loyalty-accounts/:id", h.AddUserToLoyaltyAccount)                          // Add a user to an existing loyalty account
+	authorized.GET("/loyalty-accounts/:id", h.GetLoyaltyAccountDetails)                     // Get details of a loyalty account
+	authorized.DELETE("/loyalty-accounts/:id", h.CloseLoyaltyAccount)                       // Close an account (owner)
+	authorized.POST("/loyalty-accounts/:id/transfer-ownership", h.TransferAccountOwnership) // Hand the account to another member (owner)
+	authorized.DELETE("/loyalty-accounts/:id/members/:userId", h.RemoveAccountMember)       // Take a member off the account (owner)
+	authorized.GET("/loyalty-accounts/:id/audit", h.GetAccountAuditLog)                     // List membership changes
+	admins.POST("/loyalty-accounts/:id/points", h.AdjustAccountPoints)                      // Manually adjust an account's balance
+	authorized.GET("/loyalty-accounts/:id/ledger", h.GetAccountLedger)                      // List the postings that make up the balance
+	authorized.GET("/loyalty-accounts/:id/expiring", h.GetExpiringPoints)                   // When the account's points expire
+	authorized.GET("/loyalty-accounts/:id/tier", h.GetAccountTier)                          // The account's tier and progress to the next
+
+	// Points ledger
+	admins.GET("/ledger/reconciliation", h.ReconcileLedger) // Compare cached balances with the ledger
+	admins.POST("/points-expiry/run", h.RunPointsExpiry)    // Expire points now, or see what would expire
+
+	// Earn and burn rules
+	admins.GET("/rule-sets", h.GetRuleSets)         // List published rule sets, the one in force first
+	admins.GET("/rule-sets/:version", h.GetRuleSet) // Get a rule set by version
+	admins.POST("/rule-sets", h.PublishRuleSet)     // Publish a new version of the rules
+
+	// Promotional campaigns
+	admins.GET("/campaigns", h.GetCampaigns)               // List campaigns, optionally by ?status=
+	admins.GET("/campaigns/:id", h.GetCampaign)            // Get a campaign
+	admins.POST("/campaigns", h.CreateCampaign)            // Schedule a campaign
+	admins.PUT("/campaigns/:id", h.UpdateCampaign)         // Change a campaign's details or schedule
+	admins.POST("/campaigns/:id/pause", h.PauseCampaign)   // Stop a campaign applying for now
+	admins.POST("/campaigns/:id/resume", h.ResumeCampaign) // Let a paused campaign apply again
+	admins.DELETE("/campaigns/:id", h.EndCampaign)         // End a campaign now
 
 	// Transaction history
-	router.POST("/transactions", h.ProcessTransaction) // Log a new transaction
-	// router.GET("/users/:id/transactions", h.GetUserTransactions) // Retrieve a user's transaction history
+	authorized.GET("/users/:id/transactions", h.GetUserTransactions)               // Retrieve a user's transaction history
+	authorized.GET("/loyalty-accounts/:id/transactions", h.GetAccountTransactions) // Retrieve the history of everyone on an account
+
+	// Rewards catalogue and redemptions
+	authorized.GET("/rewards", h.GetRewards)                                     // List the rewards that can be redeemed
+	authorized.GET("/rewards/:id", h.GetReward)                                  // Get a reward
+	admins.POST("/rewards", h.CreateReward)                                      // Add a reward to the catalogue
+	admins.PUT("/rewards/:id", h.UpdateReward)                                   // Change a reward's details
+	admins.DELETE("/rewards/:id", h.WithdrawReward)                              // Take a reward out of the catalogue
+	authorized.POST("/redemptions", h.Idempotent(), h.RedeemReward)              // Spend points on a reward
+	authorized.GET("/users/:id/redemptions", h.GetUserRedemptions)               // Rewards a user has redeemed
+	authorized.GET("/loyalty-accounts/:id/redemptions", h.GetAccountRedemptions) // Rewards redeemed with an account's points
+
+	// Stores
+	authorized.GET("/stores", h.GetStores)        // List the chain's stores, optionally by ?region=
+	authorized.GET("/stores/:id", h.GetStore)     // Get a store and its opening hours
+	admins.POST("/stores", h.CreateStore)         // Open a new store
+	storeAdmins.PUT("/stores/:id", h.UpdateStore) // Change a store's details and opening hours
+	admins.DELETE("/stores/:id", h.CloseStore)    // Close a store for good
+
+	// Point-of-sale terminals
+	storeAdmins.POST("/stores/:id/terminals", h.RegisterTerminal)  // Register a terminal and issue its key
+	storeAdmins.GET("/stores/:id/terminals", h.GetStoreTerminals)  // List a store's terminals
+	storeAdmins.POST("/terminals/:id/rotate", h.RotateTerminalKey) // Issue a new key, invalidating the old one
+	storeAdmins.DELETE("/terminals/:id", h.RevokeTerminal)         // Revoke a terminal's key for good
 
 	// Invitations
-	router.POST("invitations/create", h.CreateInvitation)
-	router.POST("/invitations/accept", h.AcceptInvitation)
-	router.POST("/invitations/decline", h.DeclineInvitation)
+	authorized.POST("invitations/create", h.CreateInvitation)
+	authorized.POST("/invitations/accept", h.AcceptInvitation)
+	authorized.POST("/invitations/decline", h.DeclineInvitation)
+}
+
+// Login verifies a user's email and password and issues an access and refresh token.
+func (h *Handler) Login(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	// Users log in to the region they registered in
+	if !h.routeTo(c, "users", "email_address", req.Email) {
+		return
+	}
+
+	tokens, err := h.authService.Login(c.Request.Context(), req.Email, req.Password)
+	if err != nil {
+		if errors.Is(err, user.ErrInvalidCredentials) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+			return
+		}
+		log.Printf("Error logging in: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RefreshToken issues a new token pair in exchange for a valid refresh token.
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	tokens, err := h.authService.Refresh(c.Request.Context(), req.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
 }
 
 // Register a new user
@@ -71,10 +229,35 @@ func (h *Handler) RegisterUser(c *gin.Context) {
 		return
 	}
 
+	// Users are registered in the region of their choice, ?region=, and their data stays there
+	region := c.DefaultQuery("region", db.DefaultRegion)
+	if !h.regions.Has(region) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown region"})
+		return
+	}
+
+	// Email addresses are unique across regions too, logging in finds the user by theirs
+	taken, ok := h.locate(c, "users", "email_address", newUser.Email)
+	if !ok {
+		return
+	}
+	if taken != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": user.ErrEmailTaken.Error()})
+		return
+	}
+	c.Request = c.Request.WithContext(db.WithRegion(c.Request.Context(), region))
+
 	// Call your service's createUser function and retrieve the newly created user
 	createdUser, err := h.userService.CreateUser(c.Request.Context(), newUser)
 	if err != nil {
-		// Handle specific error cases here as needed
+		if errors.Is(err, user.ErrEmailTaken) || errors.Is(err, user.ErrPhoneTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email address or phone number is already in use"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
@@ -98,12 +281,99 @@ func (h *Handler) RegisterUser(c *gin.Context) {
 	c.JSON(http.StatusCreated, userResponse)
 }
 
-// // Fetch transactions for a user.
-// func (h *Handler) GetUserTransactions(c *gin.Context) {
-// 	// Placeholder implementation. Extract user ID from path, validate it, call transactionService to fetch transactions, return the result.
-// 	userID := c.Param("id")
-// 	c.JSON(http.StatusOK, gin.H{"userID": userID, "transactions": "TODO: Need to implement"})
-// }
+// GetUserTransactions returns a page of a user's transactions, newest first.
+func (h *Handler) GetUserTransactions(c *gin.Context) {
+	userID := c.Param("id")
+	if userID != callerID(c) && !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot view another user's transactions"})
+		return
+	}
+
+	filter, ok := parseHistoryFilter(c)
+	if !ok {
+		return
+	}
+
+	page, err := h.transactionService.GetTransactionsByUserID(c.Request.Context(), userID, filter)
+	writeHistoryPage(c, page, err)
+}
+
+// GetAccountTransactions returns a page of the transactions of every member of an account, newest first.
+func (h *Handler) GetAccountTransactions(c *gin.Context) {
+	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
+		return
+	}
+
+	filter, ok := parseHistoryFilter(c)
+	if !ok {
+		return
+	}
+
+	page, err := h.transactionService.GetTransactionsByAccountID(c.Request.Context(), accountID, filter)
+	writeHistoryPage(c, page, err)
+}
+
+// parseHistoryFilter reads the history query parameters: from and to (RFC 3339 or YYYY-MM-DD),
+// store, type (earn or burn), cursor and limit.
+func parseHistoryFilter(c *gin.Context) (transaction.HistoryFilter, bool) {
+	filter := transaction.HistoryFilter{
+		StoreID: c.Query("store"),
+		Kind:    c.Query("type"),
+		Cursor:  c.Query("cursor"),
+	}
+
+	var ok bool
+	if filter.From, ok = parseDateParam(c, "from"); !ok {
+		return filter, false
+	}
+	if filter.To, ok = parseDateParam(c, "to"); !ok {
+		return filter, false
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return filter, false
+		}
+		filter.Limit = n
+	}
+
+	return filter, true
+}
+
+// parseDateParam reads an optional RFC 3339 or YYYY-MM-DD query parameter.
+func parseDateParam(c *gin.Context, param string) (*time.Time, bool) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, true
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " date"})
+		return nil, false
+	}
+
+	return &t, true
+}
+
+func writeHistoryPage(c *gin.Context, page *transaction.HistoryPage, err error) {
+	if err != nil {
+		if errors.Is(err, transaction.ErrInvalidCursor) || errors.Is(err, transaction.ErrInvalidFilter) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch transactions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
 
 // // Logs a new transaction to a user's account.
 // func (h *Handler) LogTransaction(c *gin.Context) {
@@ -116,8 +386,14 @@ func (h *Handler) GetUser(c *gin.Context) {
 	// Extract the user ID from the URL path
 	userID := c.Param("id")
 
+	// Customers can only see themselves, staff can look up anyone
+	if userID != callerID(c) && !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot view another user"})
+		return
+	}
+
 	// Use the userService to fetch the user by their ID
-	user, err := h.userService.GetUserByID(c, userID)
+	user, err := h.userService.GetUserByID(c.Request.Context(), userID)
 	if err != nil {
 		// If the user is not found or there's another error, return an appropriate response
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
@@ -125,31 +401,163 @@ func (h *Handler) GetUser(c *gin.Context) {
 	}
 
 	// If the user is found, return their details
-	c.JSON(http.StatusOK, gin.H{
-		"ID":           user.ID,
-		"AccountID":    user.AccountID,
-		"Name":         user.Name,
-		"Email":        user.Email,
-		"Phone":        user.Phone,
-		"CreationDate": user.CreationDate,
+	c.JSON(http.StatusOK, userDetails(user))
+}
+
+// SetUserRole changes a user's role. Admins can assign any role, store managers can only
+// add customers to their own store's staff or remove them from it again.
+func (h *Handler) SetUserRole(c *gin.Context) {
+	var req struct {
+		Role    string  `json:"role"`
+		StoreID *string `json:"storeID"` // required for store staff and managers
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	userID := c.Param("id")
+
+	if callerRole(c) == model.RoleStoreManager {
+		target, err := h.userService.GetUserByID(c.Request.Context(), userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		ownStore := caller(c).StoreID
+		worksHere := target.Role == model.RoleStoreStaff && target.StoreID != nil && *target.StoreID == ownStore
+		hiring := req.Role == model.RoleStoreStaff && req.StoreID != nil && *req.StoreID == ownStore &&
+			(target.Role == model.RoleCustomer || worksHere)
+		leaving := req.Role == model.RoleCustomer && worksHere
+
+		if !hiring && !leaving {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Store managers can only manage staff at their own store"})
+			return
+		}
+	}
+
+	updated, err := h.userService.SetRole(c.Request.Context(), userID, req.Role, req.StoreID)
+	if err != nil {
+		switch {
+		case errors.Is(err, user.ErrInvalidRole), errors.Is(err, user.ErrStoreNotFound):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, userDetails(updated))
+}
+
+// userDetails is the public representation of a user, leaving out the password hash.
+func userDetails(u *model.User) gin.H {
+	return gin.H{
+		"ID":           u.ID,
+		"AccountID":    u.AccountID,
+		"Name":         u.Name,
+		"Email":        u.Email,
+		"Phone":        u.Phone,
+		"Role":         u.Role,
+		"StoreID":      u.StoreID,
+		"CreationDate": u.CreationDate,
+	}
+}
+
+// UpdateUser changes some of a user's details, only the fields present in the request are updated.
+func (h *Handler) UpdateUser(c *gin.Context) {
+	var req struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Phone           *string `json:"phone"`
+		CurrentPassword *string `json:"currentPassword"` // required when changing the password
+		Password        *string `json:"password"`        // the new password
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	userID := c.Param("id")
+	self := userID == callerID(c)
+
+	// Users update themselves, admins can correct anyone's details but not set their password
+	if !self && (callerRole(c) != model.RoleAdmin || req.Password != nil) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot update another user"})
+		return
+	}
+
+	// Email addresses are unique across regions, the service only checks the user's own region
+	if req.Email != nil {
+		taken, ok := h.locate(c, "users", "email_address", *req.Email)
+		if !ok {
+			return
+		}
+		if taken != "" && taken != db.RegionFrom(c.Request.Context()) {
+			c.JSON(http.StatusConflict, gin.H{"error": user.ErrEmailTaken.Error()})
+			return
+		}
+	}
+
+	updated, err := h.userService.UpdateUser(c.Request.Context(), userID, user.Update{
+		Name:            req.Name,
+		Email:           req.Email,
+		Phone:           req.Phone,
+		CurrentPassword: req.CurrentPassword,
+		NewPassword:     req.Password,
 	})
+	if err != nil {
+		switch {
+		case errors.Is(err, user.ErrEmailTaken), errors.Is(err, user.ErrPhoneTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrDuplicatedKey):
+			c.JSON(http.StatusConflict, gin.H{"error": "Email address or phone number is already in use"})
+		case errors.Is(err, user.ErrIncorrectPassword):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, user.ErrInvalidUpdate):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, userDetails(updated))
 }
 
-// // Update user details
-// func (h *Handler) UpdateUser(c *gin.Context) {
-// 	// Implementation goes here.
-// 	c.JSON(http.StatusCreated, gin.H{"message": "TODO: Need to implement"})
-// }
+// AddUserToLoyaltyAccount adds a user to an existing loyalty account without an invitation.
+func (h *Handler) AddUserToLoyaltyAccount(c *gin.Context) {
+	var req struct {
+		UserID string `json:"userId"`
+	}
 
-// // Add a user to an existing loyalty account
-// func (h *Handler) AddUserToLoyaltyAccount(c *gin.Context) {
-// 	// Implementation goes here.
-// 	c.JSON(http.StatusCreated, gin.H{"message": "TODO: Need to implement"})
-// }
+	if err := c.ShouldBindJSON(&req); err != nil || req.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	entry, err := h.accountService.AddUserToAccount(c.Request.Context(), c.Param("id"), req.UserID, accountActor(c))
+	if err != nil {
+		if !writeAccountError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add user to account"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
 
 // CreateLoyaltyAccount handles the creation of a new loyalty account, associating it with users and setting initial points.
 func (h *Handler) CreateLoyaltyAccount(c *gin.Context) {
 	var request struct {
+		OwnerID string   `json:"ownerId"` // Owner of the account, defaults to the caller
 		UserIDs []string `json:"userIds"` // Array of user IDs to associate with the account
 		Points  int      `json:"points"`  // Initial points to assign to the account
 	}
@@ -159,12 +567,36 @@ func (h *Handler) CreateLoyaltyAccount(c *gin.Context) {
 		return
 	}
 
+	// Welcome points are a balance adjustment, which only admins can make
+	if request.Points != 0 && callerRole(c) != model.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can assign points"})
+		return
+	}
+
+	// Whoever creates the account owns it, only admins can set up accounts for other people
+	if request.OwnerID == "" {
+		request.OwnerID = callerID(c)
+	} else if request.OwnerID != callerID(c) && callerRole(c) != model.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot create an account for another user"})
+		return
+	}
+
+	// The account's home region is its owner's
+	if !h.routeTo(c, "users", "user_uuid", request.OwnerID) {
+		return
+	}
+
 	acc := model.Account{
 		Points: request.Points,
 	}
 
-	createdAccount, err := h.accountService.CreateAccount(c.Request.Context(), acc, request.UserIDs, request.Points)
+	// Everyone but admins creates an account for themselves alone and invites the others
+	actor := account.Actor{UserID: callerID(c), Admin: callerRole(c) == model.RoleAdmin}
+	createdAccount, err := h.accountService.CreateAccount(c.Request.Context(), acc, request.OwnerID, request.UserIDs, request.Points, actor)
 	if err != nil {
+		if writeAccountError(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -174,6 +606,10 @@ func (h *Handler) CreateLoyaltyAccount(c *gin.Context) {
 // Get details of a loyalty account
 func (h *Handler) GetLoyaltyAccountDetails(c *gin.Context) {
 	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
+		return
+	}
+
 	acc, err := h.accountService.GetAccount(c.Request.Context(), accountID)
 	if err != nil {
 		c.JSON(404, gin.H{"error": "Account not found"})
@@ -182,104 +618,990 @@ func (h *Handler) GetLoyaltyAccountDetails(c *gin.Context) {
 	c.JSON(200, &acc)
 }
 
-// Process a new transaction and either add points or use points based on the transaction details.
-func (h *Handler) ProcessTransaction(c *gin.Context) {
-	var trans model.Transaction
+// TransferAccountOwnership makes another member the owner of the account.
+func (h *Handler) TransferAccountOwnership(c *gin.Context) {
+	var req struct {
+		UserID string `json:"userId"` // the new owner
+	}
 
-	if err := c.ShouldBindJSON(&trans); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil || req.UserID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
 		return
 	}
 
-	usePoints := c.Query("usePoints") == "true"
+	acc, err := h.accountService.TransferOwnership(c.Request.Context(), c.Param("id"), accountActor(c), req.UserID)
+	if err != nil {
+		if !writeAccountError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer ownership"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, acc)
+}
 
-	if err := h.transactionService.ProcessTransaction(c.Request.Context(), trans, usePoints); err != nil {
-		log.Printf("Error processing transaction: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process transaction", "detail": err.Error()})
+// CloseLoyaltyAccount closes an account, removing every member and forfeiting its points.
+func (h *Handler) CloseLoyaltyAccount(c *gin.Context) {
+	acc, err := h.accountService.CloseAccount(c.Request.Context(), c.Param("id"), accountActor(c))
+	if err != nil {
+		if !writeAccountError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close account"})
+		}
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Transaction processed successfully", "id": trans.ID})
+	c.JSON(http.StatusOK, acc)
 }
 
-func (h *Handler) CreateInvitation(c *gin.Context) {
-	var req struct {
-		Email     string `json:"email"`     // Email of the person being invited
-		InviterID string `json:"inviterID"` // ID of the person sending the invitation
-		AccountID string `json:"accountID"` // ID of the account/group to which the invitee is being invited
+// RemoveAccountMember takes a member off an account (owner).
+func (h *Handler) RemoveAccountMember(c *gin.Context) {
+	entry, err := h.accountService.RemoveMember(c.Request.Context(), c.Param("id"), c.Param("userId"), accountActor(c))
+	if err != nil {
+		if !writeAccountError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		}
+		return
 	}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+	c.JSON(http.StatusOK, entry)
+}
+
+// LeaveAccount takes the user off their shared account.
+func (h *Handler) LeaveAccount(c *gin.Context) {
+	userID := c.Param("id")
+	if userID != callerID(c) && callerRole(c) != model.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot leave an account on behalf of another user"})
 		return
 	}
 
-	// `CreateInvitation` equires the email of the invitee, the inviterID, and the accountID.
-	CreatedInvitation, err := h.invitationService.CreateInvitation(c.Request.Context(), req.Email, req.InviterID, req.AccountID)
+	entry, err := h.accountService.LeaveAccount(c.Request.Context(), userID)
 	if err != nil {
-		// Handle errors as appropriate for your application
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		if !writeAccountError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave account"})
+		}
 		return
 	}
 
-	// Prepare the response, excluding the password field
-	invitationResponse := struct {
-		InvitationUUID string    `json:"invitationID"`
-		Email          string    `json:"email"`
-		AccountUUID    string    `json:"accountID"`
-		InviterUUID    string    `json:"inviterID"`
-		Token          string    `json:"token"`
-		CreationDate   time.Time `json:"creationDate"`
-		ExpirationDate time.Time `json:"expirationDate"`
-		Status         string    `json:"status"`
-	}{
-		InvitationUUID: CreatedInvitation.InvitationUUID,
-		Email:          CreatedInvitation.Email,
-		AccountUUID:    CreatedInvitation.AccountUUID,
-		InviterUUID:    CreatedInvitation.InviterUUID,
-		Token:          CreatedInvitation.Token,
-		CreationDate:   CreatedInvitation.CreationDate,
-		ExpirationDate: CreatedInvitation.ExpirationDate,
-		Status:         CreatedInvitation.Status,
+	c.JSON(http.StatusOK, entry)
+}
+
+// GetAccountAuditLog lists the membership changes made to an account.
+func (h *Handler) GetAccountAuditLog(c *gin.Context) {
+	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
+		return
 	}
 
-	c.JSON(http.StatusCreated, invitationResponse)
+	entries, err := h.accountService.GetAuditLog(c.Request.Context(), accountID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
 }
 
-func (h *Handler) AcceptInvitation(c *gin.Context) {
-	var req struct {
-		Token        string `json:"token"`
-		InviteeEmail string `json:"email"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+// GetAccountLedger lists the ledger entries that add up to an account's balance.
+func (h *Handler) GetAccountLedger(c *gin.Context) {
+	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
 		return
 	}
 
-	err := h.invitationService.AcceptInvitation(c.Request.Context(), req.Token, req.InviteeEmail)
+	entries, err := h.ledgerService.GetEntries(c.Request.Context(), accountID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch ledger"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted successfully"})
+	c.JSON(http.StatusOK, entries)
 }
 
-func (h *Handler) DeclineInvitation(c *gin.Context) {
-	var req struct {
-		Token        string `json:"token"`
-		InviteeEmail string `json:"email"`
+// ReconcileLedger reports accounts whose cached balance has drifted from the ledger.
+func (h *Handler) ReconcileLedger(c *gin.Context) {
+	report, err := h.ledgerService.Reconcile(c.Request.Context())
+	if err != nil {
+		log.Printf("Error reconciling ledger: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile ledger"})
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetExpiringPoints lists when an account's points will expire, soonest first.
+func (h *Handler) GetExpiringPoints(c *gin.Context) {
+	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
 		return
 	}
 
-	err := h.invitationService.DeclineInvitation(c.Request.Context(), req.Token, req.InviteeEmail)
+	lots, err := h.expiryService.Upcoming(c.Request.Context(), accountID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch expiring points"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined successfully"})
+	c.JSON(http.StatusOK, lots)
+}
+
+// GetAccountTier shows an account's membership tier and how much more its members need to spend
+// to reach the next one.
+func (h *Handler) GetAccountTier(c *gin.Context) {
+	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
+		return
+	}
+
+	progress, err := h.tierService.GetProgress(c.Request.Context(), accountID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch account tier"})
+		return
+	}
+
+	c.JSON(http.StatusOK, progress)
+}
+
+// RunPointsExpiry expires every point that has reached the end of its lifetime. With ?dryRun=true
+// nothing is expired and the report says what would have been.
+func (h *Handler) RunPointsExpiry(c *gin.Context) {
+	report, err := h.expiryService.ExpireAll(c.Request.Context(), c.Query("dryRun") == "true")
+	if err != nil {
+		log.Printf("Error expiring points: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to expire points"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetRuleSets lists every published rule set, newest first.
+func (h *Handler) GetRuleSets(c *gin.Context) {
+	ruleSets, err := h.rulesService.GetRuleSets(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rule sets"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ruleSets)
+}
+
+// GetRuleSet retrieves a rule set by its version, so past transactions can be explained.
+func (h *Handler) GetRuleSet(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	ruleSet, err := h.rulesService.GetRuleSet(c.Request.Context(), version)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Rule set not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rule set"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ruleSet)
+}
+
+// PublishRuleSet stores a new version of the earn and burn rules, which applies to every purchase from now on.
+func (h *Handler) PublishRuleSet(c *gin.Context) {
+	var definition rules.Definition
+	if err := c.ShouldBindJSON(&definition); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	ruleSet, err := h.rulesService.Publish(c.Request.Context(), definition, callerID(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, rules.ErrInvalidRuleSet):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, rules.ErrVersionConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("Error publishing rule set: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish rule set"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, ruleSet)
+}
+
+// GetCampaigns lists promotional campaigns. ?status=scheduled, active, paused or ended narrows the list down.
+func (h *Handler) GetCampaigns(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", campaign.StatusScheduled, campaign.StatusActive, campaign.StatusPaused, campaign.StatusEnded:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	campaigns, err := h.campaignService.GetCampaigns(c.Request.Context(), status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch campaigns"})
+		return
+	}
+
+	c.JSON(http.StatusOK, campaigns)
+}
+
+// GetCampaign retrieves a promotional campaign.
+func (h *Handler) GetCampaign(c *gin.Context) {
+	cp, err := h.campaignService.GetCampaign(c.Request.Context(), c.Param("id"))
+	writeCampaign(c, http.StatusOK, cp, err)
+}
+
+// CreateCampaign schedules a promotional campaign.
+func (h *Handler) CreateCampaign(c *gin.Context) {
+	var req campaign.Campaign
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	cp, err := h.campaignService.CreateCampaign(c.Request.Context(), req, callerID(c))
+	writeCampaign(c, http.StatusCreated, cp, err)
+}
+
+// UpdateCampaign replaces a campaign's details and schedule.
+func (h *Handler) UpdateCampaign(c *gin.Context) {
+	var req campaign.Campaign
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	cp, err := h.campaignService.UpdateCampaign(c.Request.Context(), c.Param("id"), req)
+	writeCampaign(c, http.StatusOK, cp, err)
+}
+
+// PauseCampaign stops a campaign applying to purchases until it is resumed.
+func (h *Handler) PauseCampaign(c *gin.Context) {
+	cp, err := h.campaignService.PauseCampaign(c.Request.Context(), c.Param("id"))
+	writeCampaign(c, http.StatusOK, cp, err)
+}
+
+// ResumeCampaign lets a paused campaign apply to purchases again.
+func (h *Handler) ResumeCampaign(c *gin.Context) {
+	cp, err := h.campaignService.ResumeCampaign(c.Request.Context(), c.Param("id"))
+	writeCampaign(c, http.StatusOK, cp, err)
+}
+
+// EndCampaign ends a campaign now, it is kept for the purchases it added points to.
+func (h *Handler) EndCampaign(c *gin.Context) {
+	cp, err := h.campaignService.EndCampaign(c.Request.Context(), c.Param("id"))
+	writeCampaign(c, http.StatusOK, cp, err)
+}
+
+func writeCampaign(c *gin.Context, status int, cp *campaign.Campaign, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, campaign.ErrInvalidCampaign):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		default:
+			log.Printf("Error saving campaign: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save campaign"})
+		}
+		return
+	}
+
+	c.JSON(status, cp)
+}
+
+// GetRewards lists the rewards that can be redeemed right now. Admins can see the whole catalogue with ?all=true.
+func (h *Handler) GetRewards(c *gin.Context) {
+	all := c.Query("all") == "true" && callerRole(c) == model.RoleAdmin
+
+	rewards, err := h.rewardService.GetRewards(c.Request.Context(), all)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rewards"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rewards)
+}
+
+// GetReward retrieves a reward from the catalogue.
+func (h *Handler) GetReward(c *gin.Context) {
+	rw, err := h.rewardService.GetReward(c.Request.Context(), c.Param("id"))
+	writeReward(c, http.StatusOK, rw, err)
+}
+
+// CreateReward adds a reward to the catalogue.
+func (h *Handler) CreateReward(c *gin.Context) {
+	var req model.Reward
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	rw, err := h.rewardService.CreateReward(c.Request.Context(), req)
+	writeReward(c, http.StatusCreated, rw, err)
+}
+
+// UpdateReward replaces a reward's details.
+func (h *Handler) UpdateReward(c *gin.Context) {
+	var req model.Reward
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	rw, err := h.rewardService.UpdateReward(c.Request.Context(), c.Param("id"), req)
+	writeReward(c, http.StatusOK, rw, err)
+}
+
+// WithdrawReward ends a reward's validity, it stays in the catalogue for past redemptions.
+func (h *Handler) WithdrawReward(c *gin.Context) {
+	rw, err := h.rewardService.WithdrawReward(c.Request.Context(), c.Param("id"))
+	writeReward(c, http.StatusOK, rw, err)
+}
+
+func writeReward(c *gin.Context, status int, rw *model.Reward, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, reward.ErrInvalidReward):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Reward not found"})
+		default:
+			log.Printf("Error saving reward: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save reward"})
+		}
+		return
+	}
+
+	c.JSON(status, rw)
+}
+
+// RedeemReward spends account points on a reward. Members redeem rewards for themselves,
+// staff redeem them for a customer at their store.
+func (h *Handler) RedeemReward(c *gin.Context) {
+	var req struct {
+		RewardID string `json:"rewardId"`
+		UserID   string `json:"userId"` // staff only, defaults to the caller
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.RewardID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if req.UserID == "" {
+		req.UserID = callerID(c)
+	} else if req.UserID != callerID(c) && !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot redeem rewards for another user"})
+		return
+	}
+
+	var storeID *string
+	if store := caller(c).StoreID; store != "" {
+		storeID = &store
+	}
+
+	if !h.routeTo(c, "users", "user_uuid", req.UserID) {
+		return
+	}
+
+	redemption, err := h.rewardService.Redeem(c.Request.Context(), req.RewardID, req.UserID, storeID)
+	if err != nil {
+		switch {
+		case errors.Is(err, reward.ErrRewardUnavailable), errors.Is(err, reward.ErrOutOfStock),
+			errors.Is(err, account.ErrInsufficientPoints), errors.Is(err, account.ErrAccountClosed):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, reward.ErrNoAccount):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Reward or user not found"})
+		default:
+			log.Printf("Error redeeming reward: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem reward"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, redemption)
+}
+
+// GetUserRedemptions lists the rewards a user has redeemed.
+func (h *Handler) GetUserRedemptions(c *gin.Context) {
+	userID := c.Param("id")
+	if userID != callerID(c) && !isStaff(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot view another user's redemptions"})
+		return
+	}
+
+	redemptions, err := h.rewardService.GetRedemptionsByUserID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch redemptions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, redemptions)
+}
+
+// GetAccountRedemptions lists the rewards redeemed with an account's points.
+func (h *Handler) GetAccountRedemptions(c *gin.Context) {
+	accountID := c.Param("id")
+	if !h.canViewAccount(c, accountID) {
+		return
+	}
+
+	redemptions, err := h.rewardService.GetRedemptionsByAccountID(c.Request.Context(), accountID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch redemptions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, redemptions)
+}
+
+// accountActor describes the caller to the account service, which checks they own the
+// account unless they are an admin.
+func accountActor(c *gin.Context) account.Actor {
+	return account.Actor{
+		UserID: callerID(c),
+		Admin:  callerRole(c) == model.RoleAdmin,
+	}
+}
+
+// writeAccountError responds to the account errors a caller can do something about
+// and reports whether it did.
+func writeAccountError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, account.ErrAccountFull), errors.Is(err, account.ErrAlreadyMember),
+		errors.Is(err, account.ErrAccountClosed), errors.Is(err, account.ErrInsufficientPoints),
+		errors.Is(err, account.ErrOwnerCannotLeave):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, account.ErrNotOwner), errors.Is(err, account.ErrInvitationRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, account.ErrNotMember), errors.Is(err, account.ErrInvalidPoints):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+	default:
+		return false
+	}
+	return true
+}
+
+// AdjustAccountPoints adds or removes points from an account by hand, e.g. for goodwill gestures.
+func (h *Handler) AdjustAccountPoints(c *gin.Context) {
+	var req struct {
+		Points int `json:"points"` // positive to add points, negative to remove them
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.Points == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	acc, err := h.accountService.AdjustPoints(c.Request.Context(), c.Param("id"), req.Points)
+	if err != nil {
+		if !writeAccountError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to adjust points"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, acc)
+}
+
+// canViewAccount checks that the caller is a member of the account or a member of staff,
+// writing an error response if they aren't.
+func (h *Handler) canViewAccount(c *gin.Context, accountID string) bool {
+	if isStaff(c) {
+		return true
+	}
+
+	u, err := h.userService.GetUserByID(c.Request.Context(), callerID(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return false
+	}
+
+	if u.AccountID == nil || *u.AccountID != accountID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot view another account"})
+		return false
+	}
+
+	return true
+}
+
+// Process a new transaction and either add points or use points based on the transaction details.
+func (h *Handler) ProcessTransaction(c *gin.Context) {
+	var trans model.Transaction
+
+	if err := c.ShouldBindJSON(&trans); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if trans.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing customer UserID"})
+		return
+	}
+
+	// Transactions are always recorded at the store the member of staff or terminal belongs to
+	storeID := caller(c).StoreID
+	if storeID == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Caller is not assigned to a store"})
+		return
+	}
+	if trans.StoreID != nil && *trans.StoreID != storeID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot record transactions for another store"})
+		return
+	}
+	trans.StoreID = &storeID
+
+	spend, ok := parseSpend(c)
+	if !ok {
+		return
+	}
+
+	// The purchase is recorded in the account's home region, wherever the store is
+	if !h.routeTo(c, "accounts", "account_uuid", trans.AccountID) {
+		return
+	}
+
+	receipt, err := h.transactionService.ProcessTransaction(c.Request.Context(), trans, spend)
+	if err != nil {
+		if errors.Is(err, transaction.ErrUserNotInAccount) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, transaction.ErrInvalidAmount) || errors.Is(err, transaction.ErrInvalidItems) ||
+			errors.Is(err, transaction.ErrItemsMismatch) || errors.Is(err, transaction.ErrInvalidSpend) ||
+			errors.Is(err, transaction.ErrStoreRequired) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, store.ErrStoreNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Store not found"})
+			return
+		}
+		if errors.Is(err, store.ErrStoreNotActive) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if writeAccountError(c, err) {
+			return
+		}
+		log.Printf("Error processing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process transaction", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":      "Transaction processed successfully",
+		"id":           receipt.Transaction.ID,
+		"amount":       receipt.Transaction.Amount,
+		"pointsEarned": receipt.Transaction.PointsEarned,
+		"pointsBurned": receipt.PointsBurned,
+		"discount":     receipt.Discount,
+		"amountDue":    receipt.AmountDue,
+		"campaigns":    receipt.Transaction.Campaigns,
+	})
+}
+
+// parseSpend reads how many points to spend on a purchase from the query: pointsToUse for an
+// exact number, maxPoints for at most that many, or usePoints=true for as many as it takes.
+// It returns nil when no points should be spent.
+func parseSpend(c *gin.Context) (*transaction.Spend, bool) {
+	var spend transaction.Spend
+	given := c.Query("usePoints") == "true"
+
+	for param, points := range map[string]*int{"pointsToUse": &spend.Points, "maxPoints": &spend.MaxPoints} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+			return nil, false
+		}
+		*points = n
+		given = true
+	}
+
+	if !given {
+		return nil, true
+	}
+	return &spend, true
+}
+
+// RefundTransaction gives back some or all of a purchase made at the caller's store.
+func (h *Handler) RefundTransaction(c *gin.Context) {
+	var req struct {
+		Amount *float64 `json:"amount"` // leave out to refund whatever is left of the purchase
+	}
+
+	// An empty body refunds the whole purchase
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+	}
+
+	if req.Amount != nil && *req.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be positive"})
+		return
+	}
+
+	reversal, err := h.transactionService.RefundTransaction(c.Request.Context(), c.Param("id"), req.Amount, caller(c).StoreID)
+	writeReversal(c, reversal, err)
+}
+
+// VoidTransaction cancels a purchase made at the caller's store within the void window.
+func (h *Handler) VoidTransaction(c *gin.Context) {
+	reversal, err := h.transactionService.VoidTransaction(c.Request.Context(), c.Param("id"), caller(c).StoreID)
+	writeReversal(c, reversal, err)
+}
+
+func writeReversal(c *gin.Context, reversal *transaction.Reversal, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		case errors.Is(err, transaction.ErrWrongStore):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, transaction.ErrRefundTooLarge):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, transaction.ErrNotRefundable), errors.Is(err, transaction.ErrAlreadyReversed),
+			errors.Is(err, transaction.ErrVoidWindowPassed), errors.Is(err, account.ErrInsufficientPoints):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("Error reversing transaction: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reverse transaction"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, reversal)
+}
+
+func (h *Handler) CreateInvitation(c *gin.Context) {
+	var req struct {
+		Email     string `json:"email"`     // Email of the person being invited
+		InviterID string `json:"inviterID"` // ID of the person sending the invitation
+		AccountID string `json:"accountID"` // ID of the account/group to which the invitee is being invited
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	// Invitations are always sent by the authenticated user
+	if req.InviterID == "" {
+		req.InviterID = callerID(c)
+	} else if req.InviterID != callerID(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot send invitations on behalf of another user"})
+		return
+	}
+
+	// `CreateInvitation` equires the email of the invitee, the inviterID, and the accountID.
+	CreatedInvitation, err := h.invitationService.CreateInvitation(c.Request.Context(), req.Email, req.InviterID, req.AccountID)
+	if err != nil {
+		if writeAccountError(c, err) {
+			return
+		}
+		// Handle errors as appropriate for your application
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+
+	// Prepare the response, excluding the password field
+	invitationResponse := struct {
+		InvitationUUID string    `json:"invitationID"`
+		Email          string    `json:"email"`
+		AccountUUID    string    `json:"accountID"`
+		InviterUUID    string    `json:"inviterID"`
+		Token          string    `json:"token"`
+		CreationDate   time.Time `json:"creationDate"`
+		ExpirationDate time.Time `json:"expirationDate"`
+		Status         string    `json:"status"`
+	}{
+		InvitationUUID: CreatedInvitation.InvitationUUID,
+		Email:          CreatedInvitation.Email,
+		AccountUUID:    CreatedInvitation.AccountUUID,
+		InviterUUID:    CreatedInvitation.InviterUUID,
+		Token:          CreatedInvitation.Token,
+		CreationDate:   CreatedInvitation.CreationDate,
+		ExpirationDate: CreatedInvitation.ExpirationDate,
+		Status:         CreatedInvitation.Status,
+	}
+
+	c.JSON(http.StatusCreated, invitationResponse)
+}
+
+func (h *Handler) AcceptInvitation(c *gin.Context) {
+	var req struct {
+		Token        string `json:"token"`
+		InviteeEmail string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if !h.bindInviteeEmail(c, &req.InviteeEmail) {
+		return
+	}
+
+	// The invitation is in the region of the account it invites to
+	if !h.routeTo(c, "invitations", "token", req.Token) {
+		return
+	}
+
+	err := h.invitationService.AcceptInvitation(c.Request.Context(), req.Token, req.InviteeEmail)
+	if err != nil {
+		if writeAccountError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted successfully"})
+}
+
+func (h *Handler) DeclineInvitation(c *gin.Context) {
+	var req struct {
+		Token        string `json:"token"`
+		InviteeEmail string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	if !h.bindInviteeEmail(c, &req.InviteeEmail) {
+		return
+	}
+
+	// The invitation is in the region of the account it invites to
+	if !h.routeTo(c, "invitations", "token", req.Token) {
+		return
+	}
+
+	err := h.invitationService.DeclineInvitation(c.Request.Context(), req.Token, req.InviteeEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined successfully"})
+}
+
+// bindInviteeEmail makes sure an invitation is only answered by the user it was sent to.
+// An empty email defaults to the caller's own address.
+func (h *Handler) bindInviteeEmail(c *gin.Context, email *string) bool {
+	caller, err := h.userService.GetUserByID(c.Request.Context(), callerID(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return false
+	}
+
+	if *email == "" {
+		*email = caller.Email
+	} else if *email != caller.Email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invitation was sent to a different user"})
+		return false
+	}
+
+	return true
+}
+
+// GetStores lists the chain's stores, narrowed down to a region with ?region=.
+func (h *Handler) GetStores(c *gin.Context) {
+	stores, err := h.storeService.GetStores(c.Request.Context(), c.Query("region"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch stores"})
+		return
+	}
+
+	c.JSON(http.StatusOK, stores)
+}
+
+// GetStore retrieves a store and its opening hours.
+func (h *Handler) GetStore(c *gin.Context) {
+	st, err := h.storeService.GetStore(c.Request.Context(), c.Param("id"))
+	writeStore(c, http.StatusOK, st, err)
+}
+
+// CreateStore adds a store to the registry.
+func (h *Handler) CreateStore(c *gin.Context) {
+	var req model.Store
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	st, err := h.storeService.CreateStore(c.Request.Context(), req)
+	writeStore(c, http.StatusCreated, st, err)
+}
+
+// UpdateStore replaces a store's details and opening hours. Store managers can only update their own store.
+func (h *Handler) UpdateStore(c *gin.Context) {
+	var req model.Store
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	storeID := c.Param("id")
+	if !canManageStore(c, storeID) {
+		return
+	}
+
+	st, err := h.storeService.UpdateStore(c.Request.Context(), storeID, req)
+	writeStore(c, http.StatusOK, st, err)
+}
+
+// CloseStore closes a store for good, it stays in the registry for the purchases made there.
+func (h *Handler) CloseStore(c *gin.Context) {
+	st, err := h.storeService.CloseStore(c.Request.Context(), c.Param("id"))
+	writeStore(c, http.StatusOK, st, err)
+}
+
+func writeStore(c *gin.Context, status int, st *model.Store, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidStore):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, store.ErrStoreNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Store not found"})
+		default:
+			log.Printf("Error saving store: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save store"})
+		}
+		return
+	}
+
+	c.JSON(status, st)
+}
+
+// RegisterTerminal adds a point-of-sale terminal to a store. The response contains the
+// terminal's secret, which can't be retrieved again.
+func (h *Handler) RegisterTerminal(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	storeID := c.Param("id")
+	if !canManageStore(c, storeID) {
+		return
+	}
+
+	t, secret, err := h.terminalService.RegisterTerminal(c.Request.Context(), storeID, req.Name)
+	if err != nil {
+		if errors.Is(err, terminal.ErrStoreNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Store not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register terminal"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, terminalKeyResponse(t, secret))
+}
+
+// GetStoreTerminals lists the terminals registered to a store.
+func (h *Handler) GetStoreTerminals(c *gin.Context) {
+	storeID := c.Param("id")
+	if !canManageStore(c, storeID) {
+		return
+	}
+
+	terminals, err := h.terminalService.GetTerminalsByStore(c.Request.Context(), storeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch terminals"})
+		return
+	}
+
+	c.JSON(http.StatusOK, terminals)
+}
+
+// RotateTerminalKey issues a new key for a terminal.
+func (h *Handler) RotateTerminalKey(c *gin.Context) {
+	if !h.canManageTerminal(c, c.Param("id")) {
+		return
+	}
+
+	t, secret, err := h.terminalService.RotateKey(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, terminal.ErrTerminalRevoked) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate terminal key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, terminalKeyResponse(t, secret))
+}
+
+// RevokeTerminal disables a terminal, e.g. when a till is lost or decommissioned.
+func (h *Handler) RevokeTerminal(c *gin.Context) {
+	if !h.canManageTerminal(c, c.Param("id")) {
+		return
+	}
+
+	t, err := h.terminalService.RevokeTerminal(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke terminal"})
+		return
+	}
+
+	c.JSON(http.StatusOK, t)
+}
+
+// canManageStore checks that admins or the store's own manager are making the request.
+func canManageStore(c *gin.Context, storeID string) bool {
+	if callerRole(c) == model.RoleAdmin || caller(c).StoreID == storeID {
+		return true
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{"error": "Cannot manage another store"})
+	return false
+}
+
+// canManageTerminal looks up the terminal's store and checks the caller can manage it.
+func (h *Handler) canManageTerminal(c *gin.Context, terminalID string) bool {
+	t, err := h.terminalService.GetTerminal(c.Request.Context(), terminalID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Terminal not found"})
+		return false
+	}
+
+	return canManageStore(c, t.StoreID)
+}
+
+func terminalKeyResponse(t *model.Terminal, secret string) gin.H {
+	return gin.H{
+		"terminal": t,
+		"keyID":    t.KeyID,
+		"secret":   secret,
+	}
 }
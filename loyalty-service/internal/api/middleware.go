@@ -0,0 +1,384 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"loyalty-service/internal/auth"
+	"loyalty-service/internal/idempotency"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/terminal"
+	"loyalty-service/pkg/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// key under which the authenticated user's token claims are stored on the gin context
+const callerKey = "caller"
+
+// Headers a point-of-sale terminal signs its requests with, see terminal.Service.Authenticate
+const (
+	terminalKeyHeader       = "X-Terminal-Key"
+	terminalTimestampHeader = "X-Terminal-Timestamp"
+	terminalSignatureHeader = "X-Terminal-Signature"
+)
+
+// Header clients set to make retrying a request safe, see Idempotent
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Header writes are answered with and clients send back to read their own writes, see ReadYourWrites
+const consistencyTokenHeader = "Consistency-Token"
+
+// RequireAuth rejects requests that don't carry a valid bearer access token
+// and records the caller's identity on the context for the handlers.
+func (h *Handler) RequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if header == "" || token == header {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing bearer token"})
+			return
+		}
+
+		claims, err := h.authService.VerifyAccessToken(token)
+		if err != nil {
+			if errors.Is(err, auth.ErrExpiredToken) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token has expired"})
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		c.Set(callerKey, claims)
+		c.Next()
+	}
+}
+
+// RequireTerminalOrAuth authenticates point-of-sale terminals by their request signature.
+// Requests without terminal headers fall through to RequireAuth.
+//
+// Terminals are recorded as callers with the RoleTerminal role and their store's ID.
+func (h *Handler) RequireTerminalOrAuth() gin.HandlerFunc {
+	requireAuth := h.RequireAuth()
+
+	return func(c *gin.Context) {
+		keyID := c.GetHeader(terminalKeyHeader)
+		if keyID == "" {
+			requireAuth(c)
+			return
+		}
+
+		// The body is part of the signature, read it and put it back for the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		t, err := h.terminalService.Authenticate(c.Request.Context(), keyID,
+			c.GetHeader(terminalTimestampHeader), c.GetHeader(terminalSignatureHeader),
+			c.Request.Method, c.Request.URL.RequestURI(), body)
+		if err != nil {
+			switch {
+			case errors.Is(err, terminal.ErrInvalidSignature):
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid terminal signature"})
+			case errors.Is(err, terminal.ErrTerminalRevoked):
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Terminal has been revoked"})
+			default:
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate terminal"})
+			}
+			return
+		}
+
+		c.Set(callerKey, &auth.Claims{
+			Subject: t.ID,
+			Role:    model.RoleTerminal,
+			StoreID: t.StoreID,
+		})
+		c.Next()
+	}
+}
+
+// Idempotent lets clients retry a request without it taking effect twice. Requests carrying an
+// Idempotency-Key header are only handled once per caller and key, retries with the same key and
+// body get the original response back. It must run after the caller has been authenticated.
+//
+// Responses with a server error aren't stored, so the request can be retried with the same key.
+func (h *Handler) Idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > idempotency.MaxKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency key is too long"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// A key may only be reused for exactly the same request
+		fingerprint := sha256.New()
+		fingerprint.Write([]byte(c.Request.Method + "\n" + c.Request.URL.RequestURI() + "\n"))
+		fingerprint.Write(body)
+
+		record, replay, err := h.idempotencyService.Begin(c.Request.Context(), callerID(c), key, hex.EncodeToString(fingerprint.Sum(nil)))
+		if err != nil {
+			switch {
+			case errors.Is(err, idempotency.ErrKeyReused):
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency key was already used for a different request"})
+			case errors.Is(err, idempotency.ErrInProgress):
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this idempotency key is still being processed"})
+			default:
+				log.Printf("Error checking idempotency key: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+			}
+			return
+		}
+
+		if replay {
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(record.StatusCode, "application/json; charset=utf-8", []byte(record.Response))
+			c.Abort()
+			return
+		}
+
+		// The handler may send the rest of the request to another region, see routeTo, but the key
+		// stays in the region it was claimed in
+		region := db.RegionFrom(c.Request.Context())
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Use a fresh context, the request's is cancelled if the client has already given up
+		ctx := db.WithRegion(context.Background(), region)
+		if recorder.Status() >= http.StatusInternalServerError {
+			err = h.idempotencyService.Release(ctx, record)
+		} else {
+			err = h.idempotencyService.Complete(ctx, record, recorder.Status(), recorder.body.Bytes())
+		}
+		if err != nil {
+			// The key stays marked as in progress until it expires, retries are refused rather than repeated
+			log.Printf("Error storing idempotent response: %v", err)
+		}
+	}
+}
+
+// responseRecorder keeps a copy of the response body as it is written.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// sharedPaths are routes over data every region shares, such as the stores and the rewards catalogue.
+// It only exists in the default region, services read it from there whatever region a request is sent to.
+var sharedPaths = []string{"/stores", "/terminals", "/rule-sets", "/campaigns", "/rewards"}
+
+// homeRegions are routes naming a row with their :id parameter, whose region the request is sent to.
+var homeRegions = []struct {
+	prefix, table, column string
+}{
+	{"/loyalty-accounts/:id", "accounts", "account_uuid"},
+	{"/users/:id", "users", "user_uuid"},
+	{"/transactions/:id", "transactions", "transaction_uuid"},
+}
+
+// InHomeRegion sends a request's queries to the region holding the data it is about: the account,
+// user or transaction in its path, or else the caller's own. Shared data always comes from the
+// default region, and admins can pick a region with ?region=. It must run after the caller has
+// been authenticated.
+func (h *Handler) InHomeRegion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		region := caller(c).Region
+		path := c.FullPath()
+
+		if requested := c.Query("region"); requested != "" && callerRole(c) == model.RoleAdmin {
+			region = requested
+		} else if isShared(path) {
+			region = db.DefaultRegion
+		} else {
+			for _, home := range homeRegions {
+				if !strings.HasPrefix(path, home.prefix) {
+					continue
+				}
+
+				located, ok := h.locate(c, home.table, home.column, c.Param("id"))
+				if !ok {
+					return
+				}
+				if located != "" {
+					region = located
+				}
+				break
+			}
+		}
+
+		if region == "" {
+			region = db.DefaultRegion
+		}
+		if !h.regions.Has(region) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unknown region"})
+			return
+		}
+		if !h.regions.Available(region) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Database unavailable, try again later"})
+			return
+		}
+
+		c.Request = c.Request.WithContext(db.WithRegion(c.Request.Context(), region))
+		c.Next()
+	}
+}
+
+// ReadYourWrites lets a request's reads go to the replicas of its region, unless the
+// Consistency-Token it carries says the client wrote there too recently for them to have caught
+// up. Requests that may write are answered with a new token. It must run after InHomeRegion.
+//
+// The token only covers the client's own writes, so reads about an account also stay off the
+// replicas for a while after anyone changes it, such as another member making a purchase. When
+// the account last changed is asked of a primary.
+func (h *Handler) ReadYourWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Header(consistencyTokenHeader, db.ConsistencyToken(db.RegionFrom(ctx), time.Now()))
+			c.Next()
+			return
+		}
+
+		var lastWrite time.Time
+		if region, at, ok := db.ParseConsistencyToken(c.GetHeader(consistencyTokenHeader)); ok && region == db.RegionFrom(ctx) {
+			lastWrite = at
+		}
+
+		if strings.HasPrefix(c.FullPath(), "/loyalty-accounts/:id") {
+			changed, err := h.accountService.LastWrite(ctx, c.Param("id"))
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				// Without knowing, the primaries are the safe choice
+				log.Printf("Error checking when account %s last changed: %v", c.Param("id"), err)
+				c.Next()
+				return
+			}
+			if changed.After(lastWrite) {
+				lastWrite = changed
+			}
+		}
+
+		if !lastWrite.IsZero() {
+			ctx = db.WithLastWrite(ctx, lastWrite)
+		}
+		c.Request = c.Request.WithContext(db.WithReplicaReads(ctx))
+		c.Next()
+	}
+}
+
+// routeTo sends the rest of a request's queries to the region of a row named in its body. Rows
+// that aren't found anywhere leave the request where it is, so it fails as it would have.
+func (h *Handler) routeTo(c *gin.Context, table, column, value string) bool {
+	region, ok := h.locate(c, table, column, value)
+	if !ok {
+		return false
+	}
+
+	if region != "" {
+		c.Request = c.Request.WithContext(db.WithRegion(c.Request.Context(), region))
+		// The write lands in the row's region, so that's where the client must read it back from
+		if c.Writer.Header().Get(consistencyTokenHeader) != "" {
+			c.Header(consistencyTokenHeader, db.ConsistencyToken(region, time.Now()))
+		}
+	}
+	return true
+}
+
+// locate finds the region of a row, "" if no region has it. If the regions can't be searched it
+// writes an error response and returns false.
+func (h *Handler) locate(c *gin.Context, table, column, value string) (string, bool) {
+	region, err := h.regions.Locate(c.Request.Context(), table, column, value)
+	if err != nil {
+		if errors.Is(err, db.ErrNotLocated) {
+			return "", true
+		}
+		log.Printf("Error locating %s %s: %v", table, value, err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to find the region the data is in"})
+		return "", false
+	}
+
+	return region, true
+}
+
+func isShared(path string) bool {
+	for _, prefix := range sharedPaths {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole only lets callers with one of the given roles through. It must run after RequireAuth.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := callerRole(c)
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	}
+}
+
+func caller(c *gin.Context) *auth.Claims {
+	claims, _ := c.MustGet(callerKey).(*auth.Claims)
+	return claims
+}
+
+// callerID returns the ID of the authenticated user making the request.
+func callerID(c *gin.Context) string {
+	return caller(c).Subject
+}
+
+// callerRole returns the role of the authenticated user, treating tokens without one as customers.
+func callerRole(c *gin.Context) string {
+	if role := caller(c).Role; role != "" {
+		return role
+	}
+	return model.RoleCustomer
+}
+
+// isStaff reports whether the caller works for the chain (at a store or at HQ).
+func isStaff(c *gin.Context) bool {
+	role := callerRole(c)
+	return role == model.RoleAdmin || model.IsStoreRole(role)
+}
@@ -2,9 +2,20 @@ package api
 
 import (
 	"loyalty-service/internal/account"
+	"loyalty-service/internal/auth"
+	"loyalty-service/internal/campaign"
+	"loyalty-service/internal/expiry"
+	"loyalty-service/internal/idempotency"
 	"loyalty-service/internal/invitation"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/reward"
+	"loyalty-service/internal/rules"
+	"loyalty-service/internal/store"
+	"loyalty-service/internal/terminal"
+	"loyalty-service/internal/tier"
 	"loyalty-service/internal/transaction"
 	"loyalty-service/internal/user"
+	"loyalty-service/pkg/db"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -12,17 +23,27 @@ import (
 
 
 // InitializeRouter setups and returns a new instance of *gin.Engine, including all routes and handlers.
-func InitializeRouter(db *gorm.DB) *gin.Engine {
+func InitializeRouter(db *gorm.DB, regions *db.Regions, tokenSecret, terminalSecret []byte) *gin.Engine {
 	router := gin.Default()
 
 	// Initialize services
 	userService := user.NewService(db)
-	accountService := account.NewService(db)
-	transactionService := transaction.NewService(db, accountService)
+	ledgerService := ledger.NewService(db)
+	rulesService := rules.NewService(db)
+	rewardService := reward.NewService(db, ledgerService)
+	campaignService := campaign.NewService(db)
+	storeService := store.NewService(db)
+	expiryService := expiry.NewService(db, ledgerService, expiry.DefaultLifetimeMonths)
+	tierService := tier.NewService(db, tier.DefaultGraceMonths)
+	accountService := account.NewService(db, ledgerService, account.DefaultMemberLimit, account.ExitPointsStay)
+	transactionService := transaction.NewService(db, ledgerService, rulesService, campaignService, storeService, transaction.DefaultVoidWindow, transaction.NegativeBalanceClamp)
 	invitationService := invitation.NewService(db, userService, accountService)
+	authService := auth.NewService(tokenSecret, userService)
+	terminalService := terminal.NewService(db, terminalSecret)
+	idempotencyService := idempotency.NewService(db, idempotency.DefaultRetention)
 
 	// Create the handler with services
-	handler := NewHandler(userService, transactionService, accountService, invitationService)
+	handler := NewHandler(authService, userService, transactionService, accountService, invitationService, terminalService, idempotencyService, ledgerService, rulesService, rewardService, expiryService, tierService, campaignService, storeService, regions)
 
 	// Setup route handlers
 	handler.SetupRoutes(router)
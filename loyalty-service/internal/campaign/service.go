@@ -0,0 +1,444 @@
+package campaign
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/rules"
+	"loyalty-service/pkg/db"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Where a campaign is in its life, worked out from its dates.
+const (
+	StatusScheduled = "scheduled"
+	StatusActive    = "active"
+	StatusPaused    = "paused"
+	StatusEnded     = "ended"
+)
+
+// ErrInvalidCampaign is wrapped by every error describing what is wrong with a campaign.
+var ErrInvalidCampaign = errors.New("invalid campaign")
+
+// Targeting narrows down the purchases a campaign applies to. Empty conditions match everything.
+type Targeting struct {
+	Stores     []string `json:"stores,omitempty"`
+	Regions    []string `json:"regions,omitempty"`
+	Tiers      []string `json:"tiers,omitempty"`      // member tiers
+	Categories []string `json:"categories,omitempty"` // product categories
+	SKUs       []string `json:"skus,omitempty"`       // products
+	Days       []string `json:"days,omitempty"`       // mon, tue, wed, thu, fri, sat or sun
+	From       string   `json:"from,omitempty"`       // HH:MM, inclusive
+	To         string   `json:"to,omitempty"`         // HH:MM, exclusive. Before From for windows that span midnight
+	Timezone   string   `json:"timezone,omitempty"`   // IANA zone of Days, From and To when the store's isn't known, UTC by default
+
+	// FirstPurchase only counts items the account has never bought before, going by their SKU
+	FirstPurchase bool `json:"firstPurchase,omitempty"`
+}
+
+// Campaign is a promotion that earns members extra points.
+type Campaign struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Description  string     `json:"description,omitempty"`
+	Kind         string     `json:"kind"`                  // model.CampaignMultiplier or model.CampaignBonus
+	Multiplier   float64    `json:"multiplier,omitempty"`  // multiplier campaigns only, e.g. 2 for double points
+	BonusPoints  int        `json:"bonusPoints,omitempty"` // bonus campaigns only
+	Targeting    Targeting  `json:"targeting"`
+	StartDate    time.Time  `json:"startDate"`
+	EndDate      *time.Time `json:"endDate,omitempty"`
+	PausedDate   *time.Time `json:"pausedDate,omitempty"`
+	Status       string     `json:"status"`
+	CreatedBy    *string    `json:"createdBy,omitempty"`
+	CreationDate time.Time  `json:"creationDate"`
+}
+
+// Service manages promotional campaigns and works out what they add to purchases.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new campaign service.
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// CreateCampaign schedules a campaign. Without a start date it starts straight away.
+func (s *Service) CreateCampaign(ctx context.Context, campaign Campaign, createdBy string) (*Campaign, error) {
+	if campaign.StartDate.IsZero() {
+		campaign.StartDate = time.Now()
+	}
+
+	stored, err := encode(&campaign)
+	if err != nil {
+		return nil, err
+	}
+
+	campaignID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	stored.ID = campaignID.String()
+	stored.CreatedBy = &createdBy
+	stored.CreationDate = time.Now()
+
+	if err := s.db.WithContext(ctx).Create(stored).Error; err != nil {
+		return nil, err
+	}
+
+	return decode(stored)
+}
+
+// UpdateCampaign replaces a campaign's details and schedule. Purchases it has already added to keep their points.
+func (s *Service) UpdateCampaign(ctx context.Context, campaignID string, changes Campaign) (*Campaign, error) {
+	current, err := s.get(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	if changes.StartDate.IsZero() {
+		changes.StartDate = current.StartDate
+	}
+
+	stored, err := encode(&changes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.WithContext(ctx).Model(current).
+		Select("name", "description", "kind", "multiplier", "bonus_points", "targeting", "start_date", "end_date").
+		Updates(stored).Error
+	if err != nil {
+		return nil, err
+	}
+
+	stored.ID = current.ID
+	stored.PausedDate = current.PausedDate
+	stored.CreatedBy = current.CreatedBy
+	stored.CreationDate = current.CreationDate
+	return decode(stored)
+}
+
+// PauseCampaign stops a campaign from applying until it is resumed.
+func (s *Service) PauseCampaign(ctx context.Context, campaignID string) (*Campaign, error) {
+	stored, err := s.get(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pausing twice keeps the original pause date
+	if stored.PausedDate == nil {
+		now := time.Now()
+		if err := s.db.WithContext(ctx).Model(stored).Update("paused_date", now).Error; err != nil {
+			return nil, err
+		}
+		stored.PausedDate = &now
+	}
+
+	return decode(stored)
+}
+
+// ResumeCampaign lets a paused campaign apply again, within its schedule.
+func (s *Service) ResumeCampaign(ctx context.Context, campaignID string) (*Campaign, error) {
+	stored, err := s.get(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.WithContext(ctx).Model(stored).Update("paused_date", nil).Error; err != nil {
+		return nil, err
+	}
+
+	stored.PausedDate = nil
+	return decode(stored)
+}
+
+// EndCampaign ends a campaign now. It is kept so past purchases can still say what they earned from it.
+func (s *Service) EndCampaign(ctx context.Context, campaignID string) (*Campaign, error) {
+	stored, err := s.get(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if stored.EndDate == nil || stored.EndDate.After(now) {
+		if err := s.db.WithContext(ctx).Model(stored).Update("end_date", now).Error; err != nil {
+			return nil, err
+		}
+		stored.EndDate = &now
+	}
+
+	return decode(stored)
+}
+
+// GetCampaign retrieves a campaign by its ID.
+func (s *Service) GetCampaign(ctx context.Context, campaignID string) (*Campaign, error) {
+	stored, err := s.get(ctx, campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(stored)
+}
+
+// GetCampaigns lists campaigns, latest starting first. A status narrows the list down to campaigns in it.
+func (s *Service) GetCampaigns(ctx context.Context, status string) ([]Campaign, error) {
+	var stored []model.Campaign
+	if err := s.db.WithContext(ctx).Order("start_date DESC").Order("name").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	campaigns := make([]Campaign, 0, len(stored))
+	for i := range stored {
+		campaign, err := decode(&stored[i])
+		if err != nil {
+			return nil, err
+		}
+		if status == "" || campaign.Status == status {
+			campaigns = append(campaigns, *campaign)
+		}
+	}
+
+	return campaigns, nil
+}
+
+// Running lists the campaigns running at a time, oldest first. Campaigns are shared by every
+// region, so they are read from the default region whichever region ctx names.
+func (s *Service) Running(ctx context.Context, at time.Time) ([]model.Campaign, error) {
+	var running []model.Campaign
+	err := s.db.WithContext(db.WithRegion(ctx, db.DefaultRegion)).
+		Where("paused_date IS NULL AND start_date <= ? AND (end_date IS NULL OR end_date > ?)", at, at).
+		Order("creation_date").Find(&running).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return running, nil
+}
+
+// Apply works out what the running campaigns, see Running, add to the points a purchase earns.
+// linePoints are the points each line of the purchase earns without campaigns, see
+// rules.Definition.LinePoints. It must run in the database transaction that records the purchase,
+// with the account locked, so first purchase offers can't be earned twice.
+//
+// When several multiplier campaigns apply to a line, the largest multiplier wins. Bonus campaigns
+// add their points once per purchase however many lines they apply to.
+func (s *Service) Apply(tx *gorm.DB, accountID string, running []model.Campaign, purchase rules.Purchase, linePoints []float64) ([]model.TransactionCampaign, error) {
+	if len(running) == 0 {
+		return nil, nil
+	}
+
+	bestMultiplier := make([]float64, len(purchase.Lines))
+	bestCampaign := make([]int, len(purchase.Lines))
+	bonus := make([]int, len(running))
+	bought := make(map[string]bool)
+
+	for c := range running {
+		campaign, err := decode(&running[c])
+		if err != nil {
+			return nil, err
+		}
+
+		at := purchase.LocalTime(campaign.Targeting.Timezone)
+		rule := campaign.Targeting.rule()
+
+		for i, line := range purchase.Lines {
+			if !rule.Matches(purchase, line, at) {
+				continue
+			}
+			if campaign.Targeting.FirstPurchase {
+				isNew, err := s.isNew(tx, accountID, line.SKU, bought)
+				if err != nil {
+					return nil, err
+				}
+				if !isNew {
+					continue
+				}
+			}
+
+			if campaign.Kind == model.CampaignBonus {
+				bonus[c] = campaign.BonusPoints
+			} else if campaign.Multiplier > bestMultiplier[i] {
+				bestMultiplier[i] = campaign.Multiplier
+				bestCampaign[i] = c
+			}
+		}
+	}
+
+	extra := make([]float64, len(running))
+	for i, multiplier := range bestMultiplier {
+		if multiplier > 0 {
+			extra[bestCampaign[i]] += linePoints[i] * (multiplier - 1)
+		}
+	}
+
+	var contributions []model.TransactionCampaign
+	for c := range running {
+		points := rules.Floor(extra[c]) + bonus[c]
+		if points > 0 {
+			contributions = append(contributions, model.TransactionCampaign{
+				CampaignID: running[c].ID,
+				Points:     points,
+			})
+		}
+	}
+
+	return contributions, nil
+}
+
+// isNew reports whether an account has never bought a product before. Items without a SKU can't be told apart
+// and never count as new. Answers are remembered in bought for the rest of the purchase.
+func (s *Service) isNew(tx *gorm.DB, accountID, sku string, bought map[string]bool) (bool, error) {
+	if sku == "" {
+		return false, nil
+	}
+
+	if before, ok := bought[sku]; ok {
+		return !before, nil
+	}
+
+	var count int64
+	err := tx.Model(&model.TransactionItem{}).
+		Joins("JOIN transactions ON transactions.transaction_uuid = transaction_items.transaction_uuid").
+		Where("transactions.account_uuid = ? AND transactions.transaction_type = ? AND transaction_items.sku = ?",
+			accountID, model.TransactionPurchase, sku).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	bought[sku] = count > 0
+	return count == 0, nil
+}
+
+func (s *Service) get(ctx context.Context, campaignID string) (*model.Campaign, error) {
+	var stored model.Campaign
+	if err := s.db.WithContext(ctx).First(&stored, "campaign_uuid = ?", campaignID).Error; err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+// rule expresses the targeting as an earn rule, so campaigns match purchases exactly like the rules do.
+func (t *Targeting) rule() rules.Rule {
+	return rules.Rule{
+		Stores:     t.Stores,
+		Regions:    t.Regions,
+		Tiers:      t.Tiers,
+		Categories: t.Categories,
+		SKUs:       t.SKUs,
+		Days:       t.Days,
+		From:       t.From,
+		To:         t.To,
+		Multiplier: 1,
+	}
+}
+
+func (t *Targeting) location() (*time.Location, error) {
+	if t.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(t.Timezone)
+}
+
+// validate checks that a campaign can be applied to purchases.
+func validate(campaign *Campaign) error {
+	if campaign.Name == "" {
+		return fmt.Errorf("%w: a name is required", ErrInvalidCampaign)
+	}
+
+	switch campaign.Kind {
+	case model.CampaignMultiplier:
+		if campaign.Multiplier <= 1 || math.IsNaN(campaign.Multiplier) || math.IsInf(campaign.Multiplier, 0) {
+			return fmt.Errorf("%w: multiplier must be more than 1", ErrInvalidCampaign)
+		}
+		campaign.BonusPoints = 0
+	case model.CampaignBonus:
+		if campaign.BonusPoints <= 0 {
+			return fmt.Errorf("%w: bonusPoints must be positive", ErrInvalidCampaign)
+		}
+		campaign.Multiplier = 0
+	default:
+		return fmt.Errorf("%w: kind must be %s or %s", ErrInvalidCampaign, model.CampaignMultiplier, model.CampaignBonus)
+	}
+
+	if campaign.EndDate != nil && !campaign.EndDate.After(campaign.StartDate) {
+		return fmt.Errorf("%w: endDate must be after startDate", ErrInvalidCampaign)
+	}
+
+	rule := campaign.Targeting.rule()
+	if err := rule.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCampaign, err)
+	}
+	if _, err := campaign.Targeting.location(); err != nil {
+		return fmt.Errorf("%w: unknown timezone %q", ErrInvalidCampaign, campaign.Targeting.Timezone)
+	}
+
+	return nil
+}
+
+func encode(campaign *Campaign) (*model.Campaign, error) {
+	if err := validate(campaign); err != nil {
+		return nil, err
+	}
+
+	targeting, err := json.Marshal(campaign.Targeting)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Campaign{
+		Name:        campaign.Name,
+		Description: campaign.Description,
+		Kind:        campaign.Kind,
+		Multiplier:  campaign.Multiplier,
+		BonusPoints: campaign.BonusPoints,
+		Targeting:   string(targeting),
+		StartDate:   campaign.StartDate,
+		EndDate:     campaign.EndDate,
+	}, nil
+}
+
+func decode(stored *model.Campaign) (*Campaign, error) {
+	campaign := Campaign{
+		ID:           stored.ID,
+		Name:         stored.Name,
+		Description:  stored.Description,
+		Kind:         stored.Kind,
+		Multiplier:   stored.Multiplier,
+		BonusPoints:  stored.BonusPoints,
+		StartDate:    stored.StartDate,
+		EndDate:      stored.EndDate,
+		PausedDate:   stored.PausedDate,
+		CreatedBy:    stored.CreatedBy,
+		CreationDate: stored.CreationDate,
+	}
+
+	if err := json.Unmarshal([]byte(stored.Targeting), &campaign.Targeting); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	switch {
+	case campaign.EndDate != nil && !now.Before(*campaign.EndDate):
+		campaign.Status = StatusEnded
+	case campaign.PausedDate != nil:
+		campaign.Status = StatusPaused
+	case now.Before(campaign.StartDate):
+		campaign.Status = StatusScheduled
+	default:
+		campaign.Status = StatusActive
+	}
+
+	return &campaign, nil
+}
@@ -0,0 +1,410 @@
+package expiry
+
+import (
+	"context"
+	"log"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/model"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// DefaultLifetimeMonths is how long points last unless configured otherwise.
+	DefaultLifetimeMonths = 12
+	// DefaultRunInterval is how often the expiry job runs unless configured otherwise.
+	DefaultRunInterval = 24 * time.Hour
+)
+
+// Lot is a batch of points that expire together.
+type Lot struct {
+	ExpiryDate time.Time `json:"expiryDate"`
+	Points     int       `json:"points"`
+}
+
+// AccountExpiry is how many points expired, or would expire, on an account.
+type AccountExpiry struct {
+	AccountID string `json:"accountId"`
+	Points    int    `json:"points"`
+}
+
+// Report is the result of an expiry run.
+type Report struct {
+	DryRun   bool            `json:"dryRun"` // nothing was written, the report says what would have expired
+	RunAt    time.Time       `json:"runAt"`
+	Accounts []AccountExpiry `json:"accounts"`
+	Total    int             `json:"total"`
+}
+
+// Service expires points a fixed number of months after they were added to an account.
+//
+// Every credit in an account's ledger (points earned, adjusted in, ...) is a lot that expires on
+// its own. Debits spend the oldest lots first, so the points that expire are always the ones that
+// have gone unspent the longest. A refund takes back the points the refunded purchase earned
+// instead, and points transferred to another account keep the date they expire on.
+type Service struct {
+	db             *gorm.DB
+	ledgerSvc      *ledger.Service
+	lifetimeMonths int
+}
+
+// NewService creates a new expiry service. Points expire lifetimeMonths after they are added,
+// or never if lifetimeMonths is 0.
+func NewService(db *gorm.DB, ledgerSvc *ledger.Service, lifetimeMonths int) *Service {
+	return &Service{
+		db:             db,
+		ledgerSvc:      ledgerSvc,
+		lifetimeMonths: lifetimeMonths,
+	}
+}
+
+// Upcoming lists when an account's points will expire, soonest first.
+func (s *Service) Upcoming(ctx context.Context, accountID string) ([]Lot, error) {
+	if s.lifetimeMonths <= 0 {
+		return []Lot{}, nil
+	}
+
+	lots, err := s.lots(s.db.WithContext(ctx), accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the lots by the day they expire on
+	upcoming := []Lot{}
+	for _, lot := range lots {
+		year, month, day := lot.ExpiryDate.Date()
+		date := time.Date(year, month, day, 0, 0, 0, 0, lot.ExpiryDate.Location())
+
+		if n := len(upcoming); n > 0 && upcoming[n-1].ExpiryDate.Equal(date) {
+			upcoming[n-1].Points += lot.Points
+			continue
+		}
+		upcoming = append(upcoming, Lot{ExpiryDate: date, Points: lot.Points})
+	}
+
+	return upcoming, nil
+}
+
+// ExpireAll expires the points that have reached the end of their lifetime on every open account.
+// With dryRun set nothing is written and the report says what would have expired.
+//
+// Each account is locked while its points are expired, so it is safe for several API servers
+// to run this at the same time.
+func (s *Service) ExpireAll(ctx context.Context, dryRun bool) (*Report, error) {
+	report := Report{
+		DryRun:   dryRun,
+		RunAt:    time.Now(),
+		Accounts: []AccountExpiry{},
+	}
+
+	if s.lifetimeMonths <= 0 {
+		return &report, nil
+	}
+
+	var accountIDs []string
+	err := s.db.WithContext(ctx).Model(&model.Account{}).
+		Where("closed_date IS NULL AND points_balance > 0").
+		Pluck("account_uuid", &accountIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, accountID := range accountIDs {
+		expired, err := s.expire(ctx, accountID, report.RunAt, dryRun)
+		if err != nil {
+			return nil, err
+		}
+
+		if expired > 0 {
+			report.Accounts = append(report.Accounts, AccountExpiry{AccountID: accountID, Points: expired})
+			report.Total += expired
+		}
+	}
+
+	return &report, nil
+}
+
+// Run expires points every interval until the context is cancelled. With dryRun set it only
+// logs what would expire.
+func (s *Service) Run(ctx context.Context, interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.ExpireAll(ctx, dryRun)
+			if err != nil {
+				log.Printf("Error expiring points: %v", err)
+				continue
+			}
+
+			for _, expired := range report.Accounts {
+				if dryRun {
+					log.Printf("Dry run: %d points would expire on account %s", expired.Points, expired.AccountID)
+				} else {
+					log.Printf("Expired %d points on account %s", expired.Points, expired.AccountID)
+				}
+			}
+		}
+	}
+}
+
+// expire writes an expiry entry for the points on an account whose lifetime ended before now.
+func (s *Service) expire(ctx context.Context, accountID string, now time.Time, dryRun bool) (int, error) {
+	var expired int
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var account model.Account
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_uuid = ?", accountID).Error
+		if err != nil {
+			return err
+		}
+		if account.ClosedDate != nil {
+			return nil
+		}
+
+		lots, err := s.lots(tx, accountID)
+		if err != nil {
+			return err
+		}
+
+		for _, lot := range lots {
+			if lot.ExpiryDate.After(now) {
+				break
+			}
+			expired += lot.Points
+		}
+
+		// The cached balance can only be short of the ledger if it has drifted, never take it below zero
+		if expired > account.Points {
+			expired = account.Points
+		}
+
+		if expired <= 0 || dryRun {
+			return nil
+		}
+
+		return s.ledgerSvc.Post(tx, model.LedgerExpiry, accountID, -expired, nil, "points unspent for "+monthsText(s.lifetimeMonths))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// maxTransferDepth is how many transfers back the expiry dates of transferred points are followed.
+// Points that went through more transfers than that expire as if they were added on the last one.
+const maxTransferDepth = 16
+
+// lot is a Lot together with the purchase that earned it, if any.
+type lot struct {
+	Lot
+	transactionID string
+}
+
+// lots replays an account's ledger and returns what is left of each credit with the date it
+// expires, soonest first.
+func (s *Service) lots(tx *gorm.DB, accountID string) ([]Lot, error) {
+	held, _, err := s.replay(tx, accountID, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	lots := make([]Lot, 0, len(held))
+	for _, l := range held {
+		lots = append(lots, l.Lot)
+	}
+	return lots, nil
+}
+
+// replay replays an account's ledger and returns the lots it holds, soonest to expire first.
+//
+// Debits spend the lots that expire soonest, except refunds, which take back the points earned on
+// the purchase they refund before anything else. Points transferred in keep the expiry dates they
+// had on the account they came from. With until set, the replay stops at that journal's debit and
+// also returns the lots the debit took.
+func (s *Service) replay(tx *gorm.DB, accountID, until string, depth int) (held, taken []lot, err error) {
+	var entries []model.LedgerEntry
+	err = tx.Where("account_ref = ?", accountID).Order("creation_date").Order("entry_uuid").Find(&entries).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refunded, err := refundedPurchases(tx, entries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owed := 0 // points spent beyond the balance, e.g. by a refund, are paid off by the next credits
+
+	for _, entry := range entries {
+		if entry.Points > 0 {
+			credited, err := s.credited(tx, entry, depth)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			// credited is soonest to expire first, so those are the points that pay off the debt
+			credited, _, owed = spend(credited, owed, "")
+			for _, l := range credited {
+				held = insert(held, l)
+			}
+			continue
+		}
+
+		var spent []lot
+		var short int
+		held, spent, short = spend(held, -entry.Points, refunded[entry.ID])
+		owed += short
+
+		if until != "" && entry.JournalID == until {
+			return held, spent, nil
+		}
+	}
+
+	return held, nil, nil
+}
+
+// credited returns the lots a credit adds to an account, soonest to expire first. Points earned,
+// adjusted in or given back expire a lifetime after the credit. Points transferred in expire when
+// they would have on the account they came from.
+func (s *Service) credited(tx *gorm.DB, entry model.LedgerEntry, depth int) ([]lot, error) {
+	var transactionID string
+	if entry.EntryType == model.LedgerEarn && entry.TransactionID != nil {
+		transactionID = *entry.TransactionID
+	}
+	fresh := lot{
+		Lot:           Lot{ExpiryDate: entry.CreationDate.AddDate(0, s.lifetimeMonths, 0), Points: entry.Points},
+		transactionID: transactionID,
+	}
+
+	if entry.EntryType != model.LedgerTransfer || depth >= maxTransferDepth {
+		return []lot{fresh}, nil
+	}
+
+	var debit model.LedgerEntry
+	err := tx.Where("journal_uuid = ? AND points < 0", entry.JournalID).Order("entry_uuid").Limit(1).Find(&debit).Error
+	if err != nil || debit.ID == "" {
+		return []lot{fresh}, err
+	}
+
+	_, moved, err := s.replay(tx, debit.AccountRef, entry.JournalID, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Whatever the other account didn't hold, e.g. because it owed points, is new to both
+	var credited []lot
+	for _, l := range moved {
+		l.Points = min(l.Points, fresh.Points)
+		if l.Points == 0 {
+			break
+		}
+		credited = insert(credited, l)
+		fresh.Points -= l.Points
+	}
+	if fresh.Points > 0 {
+		credited = insert(credited, fresh)
+	}
+
+	return credited, nil
+}
+
+// refundedPurchases maps each refund debit among the entries to the purchase it refunds.
+func refundedPurchases(tx *gorm.DB, entries []model.LedgerEntry) (map[string]string, error) {
+	byTransaction := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.EntryType == model.LedgerRefund && entry.Points < 0 && entry.TransactionID != nil {
+			byTransaction[*entry.TransactionID] = append(byTransaction[*entry.TransactionID], entry.ID)
+		}
+	}
+
+	refunded := make(map[string]string)
+	if len(byTransaction) == 0 {
+		return refunded, nil
+	}
+
+	ids := make([]string, 0, len(byTransaction))
+	for id := range byTransaction {
+		ids = append(ids, id)
+	}
+
+	var refunds []model.Transaction
+	err := tx.Select("transaction_uuid", "original_transaction_uuid").
+		Where("transaction_uuid IN ? AND original_transaction_uuid IS NOT NULL", ids).
+		Find(&refunds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, refund := range refunds {
+		for _, entryID := range byTransaction[refund.ID] {
+			refunded[entryID] = *refund.OriginalTransactionID
+		}
+	}
+	return refunded, nil
+}
+
+// spend takes points from lots, first from those earned on the purchase transactionID, if set, and
+// then from those that expire soonest. It returns the lots left, the points it took with the dates
+// they expire, and how many points it couldn't find.
+func spend(lots []lot, points int, transactionID string) (left, taken []lot, short int) {
+	take := func(i int) {
+		n := min(points, lots[i].Points)
+		if n <= 0 {
+			return
+		}
+		lots[i].Points -= n
+		points -= n
+		taken = append(taken, lot{Lot: Lot{ExpiryDate: lots[i].ExpiryDate, Points: n}, transactionID: lots[i].transactionID})
+	}
+
+	if transactionID != "" {
+		for i := range lots {
+			if lots[i].transactionID == transactionID {
+				take(i)
+			}
+		}
+	}
+	for i := range lots {
+		take(i)
+	}
+
+	for _, l := range lots {
+		if l.Points > 0 {
+			left = append(left, l)
+		}
+	}
+	return left, taken, points
+}
+
+// insert adds a lot after every lot that expires no later than it.
+func insert(lots []lot, l lot) []lot {
+	i := sort.Search(len(lots), func(i int) bool { return lots[i].ExpiryDate.After(l.ExpiryDate) })
+	lots = append(lots, lot{})
+	copy(lots[i+1:], lots[i:])
+	lots[i] = l
+	return lots
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func monthsText(months int) string {
+	if months == 1 {
+		return "1 month"
+	}
+	return strconv.Itoa(months) + " months"
+}
@@ -0,0 +1,93 @@
+package expiry
+
+import (
+	"context"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/testdb"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var start = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+// post writes one leg of a journal directly, so the test decides when it happened.
+func post(t *testing.T, db *gorm.DB, id, journalID, accountRef, entryType string, points int, transactionID *string, at time.Time) {
+	t.Helper()
+
+	entry := model.LedgerEntry{
+		ID: id, JournalID: journalID, AccountRef: accountRef, EntryType: entryType,
+		Points: points, TransactionID: transactionID, CreationDate: at,
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		t.Fatalf("posting %s: %v", id, err)
+	}
+}
+
+func assertLots(t *testing.T, s *Service, accountID string, want []Lot) {
+	t.Helper()
+
+	got, err := s.Upcoming(context.Background(), accountID)
+	if err != nil {
+		t.Fatalf("Upcoming: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Upcoming = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if !got[i].ExpiryDate.Equal(want[i].ExpiryDate) || got[i].Points != want[i].Points {
+			t.Errorf("Upcoming = %+v, want %+v", got, want)
+			return
+		}
+	}
+}
+
+func day(t time.Time) time.Time {
+	year, month, d := t.Date()
+	return time.Date(year, month, d, 0, 0, 0, 0, t.Location())
+}
+
+func TestRefundTakesBackThePointsThePurchaseEarned(t *testing.T) {
+	db := testdb.Open(t)
+	s := NewService(db, ledger.NewService(db), 12)
+
+	first, second, refund := "first", "second", "refund"
+	if err := db.Create(&model.Transaction{ID: refund, AccountID: "acc", UserID: "alice", OriginalTransactionID: &second}).Error; err != nil {
+		t.Fatalf("creating refund: %v", err)
+	}
+
+	post(t, db, "e1", "j1", "acc", model.LedgerEarn, 40, &first, start)
+	post(t, db, "e2", "j2", "acc", model.LedgerEarn, 30, &second, start.AddDate(0, 1, 0))
+	post(t, db, "e3", "j3", "acc", model.LedgerRefund, -30, &refund, start.AddDate(0, 2, 0))
+
+	// Spending from the oldest lot would have left the second purchase's points
+	assertLots(t, s, "acc", []Lot{{ExpiryDate: day(start.AddDate(1, 0, 0)), Points: 40}})
+}
+
+func TestTransferKeepsExpiryDates(t *testing.T) {
+	db := testdb.Open(t)
+	s := NewService(db, ledger.NewService(db), 12)
+
+	post(t, db, "e1", "j1", "from", model.LedgerAdjustment, 50, nil, start)
+	post(t, db, "e2", "j2", "from", model.LedgerAdjustment, 50, nil, start.AddDate(0, 3, 0))
+	moved := start.AddDate(0, 6, 0)
+	post(t, db, "e3", "j3", "from", model.LedgerTransfer, -70, nil, moved)
+	post(t, db, "e4", "j3", "to", model.LedgerTransfer, 70, nil, moved)
+
+	assertLots(t, s, "from", []Lot{{ExpiryDate: day(start.AddDate(1, 3, 0)), Points: 30}})
+	assertLots(t, s, "to", []Lot{
+		{ExpiryDate: day(start.AddDate(1, 0, 0)), Points: 50},
+		{ExpiryDate: day(start.AddDate(1, 3, 0)), Points: 20},
+	})
+
+	// Moving them on again still doesn't reset the clock
+	post(t, db, "e5", "j4", "to", model.LedgerTransfer, -60, nil, moved.AddDate(0, 1, 0))
+	post(t, db, "e6", "j4", "onward", model.LedgerTransfer, 60, nil, moved.AddDate(0, 1, 0))
+
+	assertLots(t, s, "onward", []Lot{
+		{ExpiryDate: day(start.AddDate(1, 0, 0)), Points: 50},
+		{ExpiryDate: day(start.AddDate(1, 3, 0)), Points: 10},
+	})
+}
@@ -0,0 +1,152 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"log"
+	"loyalty-service/internal/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultRetention is how long a key is remembered when no retention is configured.
+const DefaultRetention = 24 * time.Hour
+
+// MaxKeyLength is the longest idempotency key a client may send.
+const MaxKeyLength = 255
+
+var (
+	// ErrKeyReused is returned when a key is sent again with a different request.
+	ErrKeyReused = errors.New("idempotency key was already used for a different request")
+	// ErrInProgress is returned when a key is sent again before the first request has finished.
+	ErrInProgress = errors.New("a request with this idempotency key is still being processed")
+	// ErrKeyNotFound is returned when completing or releasing a key that isn't stored, e.g. because
+	// it was looked for in another region than the one it was claimed in.
+	ErrKeyNotFound = errors.New("idempotency key not found")
+)
+
+// Service stores the outcome of requests made with an idempotency key.
+type Service struct {
+	db        *gorm.DB
+	retention time.Duration
+}
+
+// NewService creates a new idempotency service that remembers keys for the given retention window.
+func NewService(db *gorm.DB, retention time.Duration) *Service {
+	return &Service{
+		db:        db,
+		retention: retention,
+	}
+}
+
+// Begin claims a key for a request. If the key has already been used for the same request and that
+// request finished, the stored record is returned with replay set, and the caller should send
+// the stored response instead of handling the request again.
+func (s *Service) Begin(ctx context.Context, scope, key, fingerprint string) (record *model.IdempotencyKey, replay bool, err error) {
+	now := time.Now()
+	record = &model.IdempotencyKey{
+		Scope:        scope,
+		Key:          key,
+		Fingerprint:  fingerprint,
+		CreationDate: now,
+		ExpiryDate:   now.Add(s.retention),
+	}
+
+	// The primary key makes sure only one request can claim a key, even across API servers
+	err = s.db.WithContext(ctx).Create(record).Error
+	if err == nil {
+		return record, false, nil
+	}
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, false, err
+	}
+
+	var existing model.IdempotencyKey
+	err = s.db.WithContext(ctx).First(&existing, "scope = ? AND idempotency_key = ?", scope, key).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	// An expired key that hasn't been purged yet can be used again
+	if existing.ExpiryDate.Before(now) {
+		result := s.db.WithContext(ctx).
+			Where("scope = ? AND idempotency_key = ? AND expiry_date = ?", scope, key, existing.ExpiryDate).
+			Delete(&model.IdempotencyKey{})
+		if result.Error != nil {
+			return nil, false, result.Error
+		}
+		return s.Begin(ctx, scope, key, fingerprint)
+	}
+
+	if existing.Fingerprint != fingerprint {
+		return nil, false, ErrKeyReused
+	}
+	if existing.StatusCode == 0 {
+		return nil, false, ErrInProgress
+	}
+
+	return &existing, true, nil
+}
+
+// Complete stores the response to a request so retries can be answered with it.
+func (s *Service) Complete(ctx context.Context, record *model.IdempotencyKey, statusCode int, response []byte) error {
+	record.StatusCode = statusCode
+	record.Response = string(response)
+
+	result := s.db.WithContext(ctx).Model(&model.IdempotencyKey{}).
+		Where("scope = ? AND idempotency_key = ?", record.Scope, record.Key).
+		Updates(map[string]interface{}{
+			"status_code": statusCode,
+			"response":    record.Response,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Release forgets a key whose request failed without changing anything, so it can be retried.
+func (s *Service) Release(ctx context.Context, record *model.IdempotencyKey) error {
+	result := s.db.WithContext(ctx).
+		Where("scope = ? AND idempotency_key = ?", record.Scope, record.Key).
+		Delete(&model.IdempotencyKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// PurgeExpired deletes every key whose retention window has passed and returns how many were deleted.
+func (s *Service) PurgeExpired(ctx context.Context) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expiry_date < ?", time.Now()).Delete(&model.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
+
+// Run purges expired keys every interval until the context is cancelled.
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.PurgeExpired(ctx)
+			if err != nil {
+				log.Printf("Error purging idempotency keys: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d expired idempotency keys", purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/testdb"
+	"testing"
+	"time"
+)
+
+func TestCompleteAndRelease(t *testing.T) {
+	db := testdb.Open(t)
+	s := NewService(db, DefaultRetention)
+	ctx := context.Background()
+
+	record, replay, err := s.Begin(ctx, "alice", "key", "fingerprint")
+	if err != nil || replay {
+		t.Fatalf("Begin = %v, %v, want a new claim", replay, err)
+	}
+	if _, _, err := s.Begin(ctx, "alice", "key", "fingerprint"); !errors.Is(err, ErrInProgress) {
+		t.Errorf("Begin while in progress = %v, want %v", err, ErrInProgress)
+	}
+
+	if err := s.Complete(ctx, record, 201, []byte(`{}`)); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	stored, replay, err := s.Begin(ctx, "alice", "key", "fingerprint")
+	if err != nil || !replay || stored.StatusCode != 201 {
+		t.Errorf("Begin after Complete = %+v, %v, %v, want the stored response replayed", stored, replay, err)
+	}
+
+	if err := s.Release(ctx, record); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// A key that isn't there, e.g. because it was claimed in another region, can't be completed or released
+	missing := &model.IdempotencyKey{Scope: "alice", Key: "missing", ExpiryDate: time.Now().Add(time.Hour)}
+	if err := s.Complete(ctx, missing, 201, []byte(`{}`)); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Complete of a missing key = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := s.Release(ctx, missing); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Release of a missing key = %v, want %v", err, ErrKeyNotFound)
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Service struct {
@@ -42,13 +43,6 @@ func (s *Service) GetUserByInvite(ctx context.Context, token string) (*model.Use
 }
 
 func (s *Service) CreateInvitation(ctx context.Context, email, inviterID, accountID string) (*model.Invitation, error) {
-	// Check if the inviter is part of the specified account
-	var inviter model.User
-	result := s.db.WithContext(ctx).Where("user_uuid = ? AND account_uuid = ?", inviterID, accountID).First(&inviter)
-	if result.Error != nil {
-		return nil, fmt.Errorf("failed to verify inviter: %w", result.Error)
-	}
-
 	invitationId, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
@@ -75,9 +69,38 @@ func (s *Service) CreateInvitation(ctx context.Context, email, inviterID, accoun
 		Status:         "pending",
 	}
 
-	result = s.db.WithContext(ctx).Create(&invitation)
-	if result.Error != nil {
-		return nil, fmt.Errorf("failed to create invitation: %w", result.Error)
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the account first, so its owner and members can't change between the checks and the invitation
+		var acc model.Account
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&acc, "account_uuid = ?", accountID).Error; err != nil {
+			return err
+		}
+
+		// Check if the inviter is part of the specified account
+		var inviter model.User
+		result := tx.Where("user_uuid = ? AND account_uuid = ?", inviterID, accountID).First(&inviter)
+		if result.Error != nil {
+			return fmt.Errorf("failed to verify inviter: %w", result.Error)
+		}
+
+		// Only the owner decides who joins the account
+		if acc.OwnerID == nil || *acc.OwnerID != inviterID {
+			return account.ErrNotOwner
+		}
+
+		// A pending invitation holds a seat on the account until it expires
+		if err := s.accountSvc.ReserveSeats(tx, accountID, 1, ""); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&invitation).Error; err != nil {
+			return fmt.Errorf("failed to create invitation: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &invitation, nil
@@ -100,42 +123,58 @@ func generateToken() (string, error) {
 }
 
 func (s *Service) AcceptInvitation(ctx context.Context, token string, email string) error {
-	// Find the invitation by token and ensure it's valid
-	var invitation model.Invitation
-	err := s.db.WithContext(ctx).Where("token = ? AND email = ?", token, email).First(&invitation).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return fmt.Errorf("invitation not found or does not match email")
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Find the invitation by token and ensure it's valid
+		// Locked so the invitation can't be accepted twice or declined at the same time
+		var invitation model.Invitation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token = ? AND email = ?", token, email).First(&invitation).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invitation not found or does not match email")
+			}
+			return err
 		}
-		return err
-	}
 
-	// Ensure the invitation is still valid (not expired and status is pending)
-	if invitation.Status != "pending" || invitation.ExpirationDate.Before(time.Now()) {
-		return errors.New("invitation is not valid or has expired")
-	}
+		// Ensure the invitation is still valid (not expired and status is pending)
+		if invitation.Status != "pending" || invitation.ExpirationDate.Before(time.Now()) {
+			return errors.New("invitation is not valid or has expired")
+		}
 
-	// Find user by email and update their account_uuid to the one in the invitation
-	var user model.User
-	err = s.db.WithContext(ctx).Where("email_address = ?", email).First(&user).Error
-	if err != nil {
-		return err
-	}
+		// The invitation's own seat turns into the new member's
+		if err := s.accountSvc.ReserveSeats(tx, invitation.AccountUUID, 1, invitation.InvitationUUID); err != nil {
+			return err
+		}
 
-	user.AccountID = &invitation.AccountUUID
+		// Find user by email and update their account_uuid to the one in the invitation
+		var user model.User
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("email_address = ?", email).First(&user).Error
+		if err != nil {
+			return err
+		}
 
-	// Update user account id and save the user
-	if err = s.db.WithContext(ctx).Save(&user).Error; err != nil {
-		return fmt.Errorf("failed to update user's account: %w", err)
-	}
+		// Users have to leave their current account before joining another
+		if user.AccountID != nil && *user.AccountID != invitation.AccountUUID {
+			return account.ErrAlreadyMember
+		}
 
-	// Mark invitation as accepted
-	invitation.Status = "accepted"
-	if err := s.db.WithContext(ctx).Save(&invitation).Error; err != nil {
-		return fmt.Errorf("failed to update invitation status: %w", err)
-	}
+		// Only the account changes, a role or store set meanwhile must not be overwritten
+		if err = tx.Model(&user).Update("account_uuid", invitation.AccountUUID).Error; err != nil {
+			return fmt.Errorf("failed to update user's account: %w", err)
+		}
 
-	return nil
+		// Mark invitation as accepted
+		if err := tx.Model(&invitation).Update("status", "accepted").Error; err != nil {
+			return fmt.Errorf("failed to update invitation status: %w", err)
+		}
+
+		return s.accountSvc.RecordAudit(tx, &model.AuditEntry{
+			AccountID: invitation.AccountUUID,
+			ActorID:   &user.ID,
+			UserID:    &user.ID,
+			Action:    model.AuditMemberJoined,
+			Detail:    "accepted invitation from " + invitation.InviterUUID,
+		})
+	})
 }
 
 func (s *Service) DeclineInvitation(ctx context.Context, token string, email string) error {
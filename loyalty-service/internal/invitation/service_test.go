@@ -0,0 +1,73 @@
+package invitation
+
+import (
+	"context"
+	"errors"
+	"loyalty-service/internal/account"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/testdb"
+	"loyalty-service/internal/user"
+	"testing"
+)
+
+func TestInviteAndAccept(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+	s := NewService(db, user.NewService(db), account.NewService(db, ledger.NewService(db), account.DefaultMemberLimit, account.ExitPointsStay))
+
+	acc, owner, member := "acc", "owner", "member"
+	store := "store"
+	seed := []interface{}{
+		&model.Store{ID: store, Name: "Store", Status: model.StoreActive},
+		&model.User{ID: owner, Name: "Owner", Email: "owner@example.com", Phone: "1", Role: model.RoleCustomer},
+		&model.Account{ID: acc, OwnerID: &owner},
+		&model.User{ID: member, AccountID: &acc, Name: "Member", Email: "member@example.com", Phone: "2", Role: model.RoleCustomer},
+		// A staff member may be a customer too
+		&model.User{ID: "guest", Name: "Guest", Email: "guest@example.com", Phone: "3", Role: model.RoleStoreStaff, StoreID: &store},
+	}
+	for _, row := range seed {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+	}
+	if err := db.Model(&model.User{}).Where("user_uuid = ?", owner).Update("account_uuid", acc).Error; err != nil {
+		t.Fatalf("seeding: %v", err)
+	}
+
+	if _, err := s.CreateInvitation(ctx, "guest@example.com", member, acc); !errors.Is(err, account.ErrNotOwner) {
+		t.Errorf("CreateInvitation by a member = %v, want %v", err, account.ErrNotOwner)
+	}
+
+	invitation, err := s.CreateInvitation(ctx, "guest@example.com", owner, acc)
+	if err != nil {
+		t.Fatalf("CreateInvitation: %v", err)
+	}
+
+	if err := s.AcceptInvitation(ctx, invitation.Token, "guest@example.com"); err != nil {
+		t.Fatalf("AcceptInvitation: %v", err)
+	}
+
+	var guest model.User
+	if err := db.First(&guest, "user_uuid = ?", "guest").Error; err != nil {
+		t.Fatalf("loading guest: %v", err)
+	}
+	if guest.AccountID == nil || *guest.AccountID != acc {
+		t.Errorf("guest's account = %v, want %s", guest.AccountID, acc)
+	}
+	if guest.Role != model.RoleStoreStaff || guest.StoreID == nil || *guest.StoreID != store {
+		t.Errorf("guest's role = %s at %v, want their staff role kept", guest.Role, guest.StoreID)
+	}
+
+	var stored model.Invitation
+	if err := db.First(&stored, "invitation_uuid = ?", invitation.InvitationUUID).Error; err != nil {
+		t.Fatalf("loading invitation: %v", err)
+	}
+	if stored.Status != "accepted" {
+		t.Errorf("invitation status = %s, want accepted", stored.Status)
+	}
+
+	if err := s.AcceptInvitation(ctx, invitation.Token, "guest@example.com"); err == nil {
+		t.Error("AcceptInvitation twice succeeded, want an error")
+	}
+}
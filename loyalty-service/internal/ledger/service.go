@@ -0,0 +1,276 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"loyalty-service/internal/model"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DefaultReconcileInterval is how often the reconciliation job runs unless configured otherwise.
+const DefaultReconcileInterval = time.Hour
+
+// System accounts on the other side of points entering or leaving circulation.
+const (
+	SystemIssued      = "system:issued"      // points earned on purchases
+	SystemRedeemed    = "system:redeemed"    // points spent on purchases
+	SystemAdjustments = "system:adjustments" // points added or removed by hand
+	SystemExpired     = "system:expired"     // points that expired or were forfeited
+	SystemOpening     = "system:opening"     // balances from before the ledger existed
+)
+
+// counterparts maps each kind of entry to the system account it is balanced against.
+var counterparts = map[string]string{
+	model.LedgerEarn:       SystemIssued,
+	model.LedgerBurn:       SystemRedeemed,
+	model.LedgerAdjustment: SystemAdjustments,
+	model.LedgerExpiry:     SystemExpired,
+	model.LedgerOpening:    SystemOpening,
+}
+
+var (
+	// ErrInsufficientPoints is returned when a posting would take an account's balance below zero.
+	ErrInsufficientPoints = errors.New("insufficient points")
+	// ErrAccountClosed is returned when posting to an account that has been closed.
+	ErrAccountClosed = errors.New("account is closed")
+	// ErrUnbalanced is returned when a posting's entries don't add up to zero.
+	ErrUnbalanced = errors.New("ledger entries must add up to zero")
+)
+
+// Leg is one side of a posting: points credited to (positive) or debited from (negative) an account.
+type Leg struct {
+	AccountRef    string
+	Points        int
+	AllowNegative bool // let the leg take a loyalty account's balance below zero
+}
+
+// Drift is an account whose cached points_balance doesn't match its ledger.
+type Drift struct {
+	AccountID     string `json:"accountId"`
+	CachedBalance int    `json:"cachedBalance"`
+	LedgerBalance int    `json:"ledgerBalance"`
+}
+
+// Report is the result of reconciling the cached balances against the ledger.
+type Report struct {
+	CheckedAt          time.Time `json:"checkedAt"`
+	Drift              []Drift   `json:"drift"`
+	UnbalancedJournals []string  `json:"unbalancedJournals"` // postings whose entries don't add up to zero
+}
+
+// Service records every change to a points balance as double-entry ledger postings.
+//
+// The ledger is the source of truth. The points_balance column on accounts is a cache of the
+// sum of an account's entries, kept up to date in the same database transaction as the
+// entries and checked by Reconcile.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new ledger service.
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// Post moves points between a loyalty account and the system account that balances entries of
+// the given type. Positive points credit the account, negative points debit it.
+func (s *Service) Post(tx *gorm.DB, entryType, accountID string, points int, transactionID *string, description string) error {
+	counterpart, ok := counterparts[entryType]
+	if !ok {
+		return fmt.Errorf("no system account balances %q entries", entryType)
+	}
+
+	return s.Record(tx, entryType, transactionID, description,
+		Leg{AccountRef: accountID, Points: points},
+		Leg{AccountRef: counterpart, Points: -points},
+	)
+}
+
+// Transfer moves points from one loyalty account to another.
+func (s *Service) Transfer(tx *gorm.DB, fromID, toID string, points int, description string) error {
+	return s.Record(tx, model.LedgerTransfer, nil, description,
+		Leg{AccountRef: fromID, Points: -points},
+		Leg{AccountRef: toID, Points: points},
+	)
+}
+
+// Record writes a posting as part of the transaction tx and updates the cached balance of every
+// loyalty account involved. It fails if the legs don't add up to zero, if an account is closed or
+// if a balance would go below zero and the leg doesn't allow it.
+func (s *Service) Record(tx *gorm.DB, entryType string, transactionID *string, description string, legs ...Leg) error {
+	sum := 0
+	for _, leg := range legs {
+		sum += leg.Points
+	}
+	if len(legs) < 2 || sum != 0 {
+		return ErrUnbalanced
+	}
+
+	journalID, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, leg := range legs {
+		entryID, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+
+		entry := model.LedgerEntry{
+			ID:            entryID.String(),
+			JournalID:     journalID.String(),
+			AccountRef:    leg.AccountRef,
+			EntryType:     entryType,
+			Points:        leg.Points,
+			TransactionID: transactionID,
+			Description:   description,
+			CreationDate:  now,
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+
+		if !isSystemAccount(leg.AccountRef) {
+			if err := s.applyBalance(tx, leg.AccountRef, leg.Points, leg.AllowNegative); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyBalance updates an account's cached balance by delta.
+//
+// The change is a single conditional UPDATE relative to the stored balance, so concurrent
+// changes can't overwrite each other and the balance can't go below zero unless allowNegative is set.
+func (s *Service) applyBalance(tx *gorm.DB, accountID string, delta int, allowNegative bool) error {
+	query := tx.Model(&model.Account{}).Where("account_uuid = ? AND closed_date IS NULL", accountID)
+	if !allowNegative {
+		query = query.Where("points_balance + ? >= 0", delta)
+	}
+
+	result := query.Updates(map[string]interface{}{
+		"points_balance":  gorm.Expr("points_balance + ?", delta),
+		"last_write_date": time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	// Nothing was updated, find out why
+	var account model.Account
+	if err := tx.First(&account, "account_uuid = ?", accountID).Error; err != nil {
+		return err
+	}
+
+	if account.ClosedDate != nil {
+		return ErrAccountClosed
+	}
+
+	return ErrInsufficientPoints
+}
+
+// Touch records a change to an account that didn't go through the ledger, such as a purchase
+// that earned nothing, as part of the transaction tx. See model.Account.LastWriteDate.
+func (s *Service) Touch(tx *gorm.DB, accountID string) error {
+	return tx.Model(&model.Account{}).Where("account_uuid = ?", accountID).Update("last_write_date", time.Now()).Error
+}
+
+// GetEntries lists the ledger entries of a loyalty account, newest first.
+func (s *Service) GetEntries(ctx context.Context, accountID string) ([]model.LedgerEntry, error) {
+	var entries []model.LedgerEntry
+	err := s.db.WithContext(ctx).Where("account_ref = ?", accountID).
+		Order("creation_date DESC").Order("entry_uuid DESC").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Balance adds up an account's ledger entries.
+func (s *Service) Balance(ctx context.Context, accountID string) (int, error) {
+	var balance int
+	err := s.db.WithContext(ctx).Model(&model.LedgerEntry{}).Select("COALESCE(SUM(points), 0)").
+		Where("account_ref = ?", accountID).Scan(&balance).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, nil
+}
+
+// Reconcile compares every account's cached balance with its ledger and checks that every
+// posting balances. It only reports what it finds, nothing is corrected.
+func (s *Service) Reconcile(ctx context.Context) (*Report, error) {
+	report := Report{
+		CheckedAt:          time.Now(),
+		Drift:              []Drift{},
+		UnbalancedJournals: []string{},
+	}
+
+	err := s.db.WithContext(ctx).Table("accounts a").
+		Select("a.account_uuid AS account_id, a.points_balance AS cached_balance, COALESCE(SUM(l.points), 0) AS ledger_balance").
+		Joins("LEFT JOIN ledger_entries l ON l.account_ref = a.account_uuid").
+		Group("a.account_uuid, a.points_balance").
+		Having("a.points_balance <> COALESCE(SUM(l.points), 0)").
+		Scan(&report.Drift).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.WithContext(ctx).Model(&model.LedgerEntry{}).Select("journal_uuid").
+		Group("journal_uuid").Having("SUM(points) <> 0").
+		Scan(&report.UnbalancedJournals).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// Run reconciles the ledger every interval until the context is cancelled, logging any drift.
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := s.Reconcile(ctx)
+			if err != nil {
+				log.Printf("Error reconciling points ledger: %v", err)
+				continue
+			}
+
+			for _, drift := range report.Drift {
+				log.Printf("Ledger drift on account %s: cached balance %d, ledger balance %d",
+					drift.AccountID, drift.CachedBalance, drift.LedgerBalance)
+			}
+			for _, journalID := range report.UnbalancedJournals {
+				log.Printf("Unbalanced ledger journal %s", journalID)
+			}
+		}
+	}
+}
+
+func isSystemAccount(ref string) bool {
+	return strings.HasPrefix(ref, "system:")
+}
@@ -0,0 +1,532 @@
+package migration
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"loyalty-service/internal/model"
+	"loyalty-service/pkg/db"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Scripts are named <version>_<name>.up.sql and <version>_<name>.down.sql. Statements end with a
+// semicolon at the end of a line, and lines starting with -- are comments. The session variable
+// @region holds the region a script runs in.
+//
+//go:embed sql/*.sql
+var scripts embed.FS
+
+var (
+	// ErrNotVersioned is returned when the database has no record of its schema version.
+	ErrNotVersioned = errors.New("the schema isn't versioned, run migrate up")
+	// ErrDirty is returned when a migration failed part way through and must be fixed by hand.
+	ErrDirty = errors.New("a migration failed part way through, fix the schema by hand and remove its dirty record")
+	// ErrChecksumMismatch is returned when an applied migration's script has been changed since.
+	ErrChecksumMismatch = errors.New("an applied migration has been changed since")
+	// ErrIncompatible is returned when the database's schema is older or newer than the service's.
+	ErrIncompatible = errors.New("the schema version doesn't match the service")
+	// ErrUnknownSchema is returned when a database created before the schema was versioned doesn't
+	// have every table and column of the first migration, so it can't be adopted as that version.
+	ErrUnknownSchema = errors.New("the existing schema isn't the first migration's, bring it up to date by hand")
+)
+
+// Migration is one version of the schema.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // SHA-256 of Up
+}
+
+// Status is a migration and whether it has been applied.
+type Status struct {
+	Version     int
+	Name        string
+	Applied     bool
+	AppliedDate *time.Time
+	Dirty       bool
+	Modified    bool // applied from a script that has been changed since
+}
+
+// migrations are the embedded migrations, oldest first.
+var migrations = load()
+
+// Service applies and rolls back the schema migrations built into the service.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new migration service.
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// Latest returns the schema version the service is built for.
+func Latest() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Status lists every migration the service knows of or the database has applied, oldest first.
+func (s *Service) Status(ctx context.Context) ([]Status, error) {
+	applied, err := s.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(migrations))
+	for _, m := range migrations {
+		status := Status{Version: m.Version, Name: m.Name}
+		if record, ok := applied[m.Version]; ok {
+			appliedDate := record.AppliedDate
+			status.Applied = true
+			status.AppliedDate = &appliedDate
+			status.Dirty = record.Dirty
+			status.Modified = record.Checksum != m.Checksum
+			delete(applied, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	// Migrations applied by a newer version of the service
+	for _, record := range applied {
+		appliedDate := record.AppliedDate
+		statuses = append(statuses, Status{
+			Version:     record.Version,
+			Name:        record.Name,
+			Applied:     true,
+			AppliedDate: &appliedDate,
+			Dirty:       record.Dirty,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// Check makes sure the database's schema is the version the service is built for, with no failed
+// or changed migrations.
+func (s *Service) Check(ctx context.Context) error {
+	versioned, err := s.hasTable(ctx, model.SchemaMigration{}.TableName())
+	if err != nil {
+		return err
+	}
+	if !versioned {
+		return ErrNotVersioned
+	}
+
+	statuses, err := s.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	for _, status := range statuses {
+		if status.Dirty {
+			return fmt.Errorf("%w: version %d", ErrDirty, status.Version)
+		}
+		if status.Modified {
+			return fmt.Errorf("%w: version %d", ErrChecksumMismatch, status.Version)
+		}
+		if status.Applied {
+			version = status.Version
+		}
+	}
+
+	if version != Latest() {
+		return fmt.Errorf("%w: the database is at version %d, the service needs version %d", ErrIncompatible, version, Latest())
+	}
+	return nil
+}
+
+// Up applies every migration the database doesn't have yet, and returns how many it applied.
+//
+// Databases created before the schema was versioned already have the tables of the first
+// migration, which is recorded as applied without running it once they are checked to have all
+// of its tables and columns.
+func (s *Service) Up(ctx context.Context) (int, error) {
+	if err := s.prepare(ctx); err != nil {
+		return 0, err
+	}
+
+	applied, err := s.verify(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		if err := s.up(ctx, m); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Down rolls back the newest steps migrations, and returns how many it rolled back.
+func (s *Service) Down(ctx context.Context, steps int) (int, error) {
+	if err := s.prepare(ctx); err != nil {
+		return 0, err
+	}
+
+	applied, err := s.verify(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+
+		if err := s.down(ctx, m); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// prepare creates the table of applied migrations, and adopts a schema created before it existed.
+// A schema that doesn't match the first migration is refused before anything is written.
+func (s *Service) prepare(ctx context.Context) error {
+	db := s.db.WithContext(ctx)
+
+	versioned, err := s.hasTable(ctx, model.SchemaMigration{}.TableName())
+	if err != nil || versioned {
+		return err
+	}
+
+	existing, err := s.hasTable(ctx, "accounts")
+	if err != nil {
+		return err
+	}
+	if existing {
+		if err := s.checkBaseline(ctx); err != nil {
+			return err
+		}
+	}
+
+	err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    checksum CHAR(64) NOT NULL,
+    dirty BOOL NOT NULL,
+    applied_date DATETIME NOT NULL
+) ENGINE=NDBCLUSTER`).Error
+	if err != nil || !existing {
+		return err
+	}
+
+	first := migrations[0]
+	return db.Create(&model.SchemaMigration{
+		Version:     first.Version,
+		Name:        first.Name,
+		Checksum:    first.Checksum,
+		AppliedDate: time.Now(),
+	}).Error
+}
+
+// verify returns the applied migrations, unless one of them is dirty, has been changed since or
+// was applied by a newer version of the service.
+func (s *Service) verify(ctx context.Context) (map[int]model.SchemaMigration, error) {
+	statuses, err := s.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range statuses {
+		switch {
+		case status.Dirty:
+			return nil, fmt.Errorf("%w: version %d", ErrDirty, status.Version)
+		case status.Modified:
+			return nil, fmt.Errorf("%w: version %d", ErrChecksumMismatch, status.Version)
+		case status.Version > Latest():
+			return nil, fmt.Errorf("%w: the database has version %d, the service only knows up to version %d",
+				ErrIncompatible, status.Version, Latest())
+		}
+	}
+
+	return s.applied(ctx)
+}
+
+// checkBaseline makes sure the database has every table and column the first migration creates.
+func (s *Service) checkBaseline(ctx context.Context) error {
+	var missing []string
+	for _, table := range baseline(migrations[0].Up) {
+		var columns []string
+		err := s.db.WithContext(ctx).
+			Raw("SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?", table.name).
+			Scan(&columns).Error
+		if err != nil {
+			return err
+		}
+
+		if len(columns) == 0 {
+			missing = append(missing, table.name)
+			continue
+		}
+
+		found := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			found[strings.ToLower(column)] = true
+		}
+		for _, column := range table.columns {
+			if !found[column] {
+				missing = append(missing, table.name+"."+column)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w, it is missing %s", ErrUnknownSchema, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// hasTable reports whether the database has a table. Unlike gorm's migrator it doesn't take a
+// database that can't be asked for one that doesn't have it.
+func (s *Service) hasTable(ctx context.Context, table string) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).
+		Raw("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?", table).
+		Scan(&count).Error
+	return count > 0, err
+}
+
+func (s *Service) applied(ctx context.Context) (map[int]model.SchemaMigration, error) {
+	var records []model.SchemaMigration
+	if err := s.db.WithContext(ctx).Order("version").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]model.SchemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// up applies a migration. MySQL commits every schema change on its own, so a migration that fails
+// part way through can't be rolled back and is left dirty.
+func (s *Service) up(ctx context.Context, m Migration) error {
+	db := s.db.WithContext(ctx)
+
+	record := model.SchemaMigration{
+		Version:     m.Version,
+		Name:        m.Name,
+		Checksum:    m.Checksum,
+		Dirty:       true,
+		AppliedDate: time.Now(),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return err
+	}
+
+	if err := s.run(ctx, m, m.Up); err != nil {
+		return err
+	}
+
+	return db.Model(&record).Update("dirty", false).Error
+}
+
+// down rolls back a migration, leaving it dirty if it fails part way through.
+func (s *Service) down(ctx context.Context, m Migration) error {
+	db := s.db.WithContext(ctx)
+
+	err := db.Model(&model.SchemaMigration{}).Where("version = ?", m.Version).Update("dirty", true).Error
+	if err != nil {
+		return err
+	}
+
+	if err := s.run(ctx, m, m.Down); err != nil {
+		return err
+	}
+
+	return db.Delete(&model.SchemaMigration{}, "version = ?", m.Version).Error
+}
+
+// run runs a script's statements in order on one connection to the context's region, so they can
+// share session variables, with @region set to the region for scripts that differ between regions.
+// The transaction only keeps them on one connection, schema changes still commit on their own.
+func (s *Service) run(ctx context.Context, m Migration, script string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET @region = ?", db.RegionFrom(ctx)).Error; err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+
+		for i, statement := range statements(script) {
+			if err := tx.Exec(statement).Error; err != nil {
+				return fmt.Errorf("migration %d %s, statement %d: %w", m.Version, m.Name, i+1, err)
+			}
+		}
+		return nil
+	})
+}
+
+// table is a table a script creates and the columns it gives it.
+type table struct {
+	name    string
+	columns []string
+}
+
+// baseline lists the tables a script creates, with the columns of their CREATE TABLE statements
+// and those added to them by ALTER TABLE ... ADD COLUMN, in the order the script creates them.
+func baseline(script string) []table {
+	var tables []table
+	index := make(map[string]int)
+
+	add := func(name, column string) {
+		i, ok := index[name]
+		if !ok {
+			i = len(tables)
+			index[name] = i
+			tables = append(tables, table{name: name})
+		}
+		if column != "" {
+			tables[i].columns = append(tables[i].columns, column)
+		}
+	}
+
+	for _, statement := range statements(script) {
+		lines := strings.Split(statement, "\n")
+		words := strings.Fields(lines[0])
+
+		switch {
+		case len(words) >= 3 && strings.EqualFold(words[0], "CREATE") && strings.EqualFold(words[1], "TABLE"):
+			name := words[len(words)-1]
+			if name == "(" {
+				name = words[len(words)-2]
+			}
+			name = strings.TrimSuffix(name, "(")
+			add(name, "")
+
+			for _, line := range lines[1:] {
+				fields := strings.Fields(line)
+				if len(fields) == 0 || strings.HasPrefix(fields[0], ")") {
+					continue
+				}
+				switch strings.ToUpper(fields[0]) {
+				case "PRIMARY", "INDEX", "KEY", "UNIQUE", "CONSTRAINT", "FOREIGN":
+					continue
+				}
+				add(name, strings.ToLower(fields[0]))
+			}
+
+		case len(words) >= 3 && strings.EqualFold(words[0], "ALTER") && strings.EqualFold(words[1], "TABLE"):
+			name := words[2]
+			for _, line := range lines[1:] {
+				fields := strings.Fields(line)
+				if len(fields) >= 3 && strings.EqualFold(fields[0], "ADD") && strings.EqualFold(fields[1], "COLUMN") {
+					add(name, strings.ToLower(fields[2]))
+				}
+			}
+		}
+	}
+
+	return tables
+}
+
+// statements splits a script into its statements, without comments.
+func statements(script string) []string {
+	var statements []string
+	var current strings.Builder
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+
+	return statements
+}
+
+// load reads the embedded scripts. They are part of the binary, so any mistake in them is a
+// mistake in the build.
+func load() []Migration {
+	entries, err := scripts.ReadDir("sql")
+	if err != nil {
+		panic(err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		base := strings.TrimSuffix(file, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+
+		prefix, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 || (direction != ".up" && direction != ".down") {
+			panic(fmt.Sprintf("migration %s must be named <version>_<name>.up.sql or <version>_<name>.down.sql", file))
+		}
+
+		content, err := scripts.ReadFile("sql/" + file)
+		if err != nil {
+			panic(err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			panic(fmt.Sprintf("migration %d has scripts with different names", version))
+		}
+
+		if direction == ".up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	loaded := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			panic(fmt.Sprintf("migration %d must have an up and a down script", m.Version))
+		}
+		loaded = append(loaded, *m)
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Version < loaded[j].Version })
+
+	if len(loaded) == 0 {
+		panic("no migrations embedded")
+	}
+	return loaded
+}
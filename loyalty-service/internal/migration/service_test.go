@@ -0,0 +1,67 @@
+package migration
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBaseline(t *testing.T) {
+	tables := baseline(migrations[0].Up)
+
+	byName := make(map[string][]string)
+	for _, table := range tables {
+		byName[table.name] = table.columns
+	}
+
+	tests := []struct {
+		table   string
+		columns []string
+	}{
+		// Created with the table
+		{"accounts", []string{"account_uuid", "owner_id", "creation_date", "region"}},
+		// Added later on by ALTER TABLE
+		{"accounts", []string{"points_balance"}},
+		{"users", []string{"password"}},
+		{"invitations", []string{"token", "status"}},
+	}
+	for _, tt := range tests {
+		columns, ok := byName[tt.table]
+		if !ok {
+			t.Errorf("baseline has no %s table", tt.table)
+			continue
+		}
+		have := make(map[string]bool, len(columns))
+		for _, column := range columns {
+			have[column] = true
+		}
+		for _, column := range tt.columns {
+			if !have[column] {
+				t.Errorf("baseline %s columns = %v, missing %s", tt.table, columns, column)
+			}
+		}
+	}
+
+	// Keys and constraints aren't columns
+	for _, table := range tables {
+		for _, column := range table.columns {
+			switch column {
+			case "primary", "index", "key", "unique", "constraint", "foreign":
+				t.Errorf("baseline %s has a column named %s", table.name, column)
+			}
+		}
+	}
+
+	if want := strings.Count(migrations[0].Up, "CREATE TABLE"); len(tables) != want {
+		t.Errorf("baseline has %d tables, want %d", len(tables), want)
+	}
+
+	// The first migration is the schema from before migrations, everything since is added by later ones
+	for _, table := range tables {
+		for _, column := range table.columns {
+			switch column {
+			case "role", "closed_date", "tier", "timezone":
+				t.Errorf("baseline %s has %s, which was added after it", table.name, column)
+			}
+		}
+	}
+}
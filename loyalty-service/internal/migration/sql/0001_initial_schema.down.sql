@@ -0,0 +1,9 @@
+-- Drop every table of the initial schema, in one statement so foreign keys between them don't get in the way
+DROP TABLE IF EXISTS
+    transaction_items,
+    transactions,
+    points_redemption,
+    invitations,
+    users,
+    accounts,
+    stores;
@@ -0,0 +1,3 @@
+-- Undoes the up script: widens invitation tokens from CHAR(16) back to CHAR(36), the size of a UUID
+ALTER TABLE invitations
+MODIFY token CHAR(36) NOT NULL;
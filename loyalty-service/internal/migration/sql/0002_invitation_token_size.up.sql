@@ -0,0 +1,3 @@
+-- Invitation tokens are 16 letters, not UUIDs
+ALTER TABLE invitations
+MODIFY token CHAR(16) NOT NULL;
@@ -0,0 +1,7 @@
+-- Remove roles and home stores from users
+ALTER TABLE users
+DROP FOREIGN KEY fk_users_stores;
+
+ALTER TABLE users
+DROP COLUMN store_uuid,
+DROP COLUMN role;
@@ -0,0 +1,5 @@
+-- Add role and home store to users
+ALTER TABLE users
+ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'customer',
+ADD COLUMN store_uuid CHAR(36),
+ADD CONSTRAINT fk_users_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid);
@@ -0,0 +1,2 @@
+-- Drop the pos_terminals table
+DROP TABLE IF EXISTS pos_terminals;
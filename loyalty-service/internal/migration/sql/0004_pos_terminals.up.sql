@@ -0,0 +1,11 @@
+-- Create the pos_terminals table
+CREATE TABLE IF NOT EXISTS pos_terminals (
+    terminal_uuid CHAR(36) PRIMARY KEY,
+    store_uuid CHAR(36) NOT NULL,
+    name VARCHAR(255),
+    key_id CHAR(32) UNIQUE NOT NULL,
+    creation_date DATETIME NOT NULL,
+    rotation_date DATETIME,
+    revocation_date DATETIME,
+    CONSTRAINT fk_pos_terminals_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid)
+) ENGINE=NDBCLUSTER;
@@ -0,0 +1,4 @@
+-- Drop the transaction history indexes
+ALTER TABLE transactions
+DROP INDEX idx_transactions_user_date,
+DROP INDEX idx_transactions_account_date;
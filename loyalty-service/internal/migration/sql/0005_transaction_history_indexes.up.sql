@@ -0,0 +1,4 @@
+-- Indexes for paging through transaction histories newest first
+ALTER TABLE transactions
+ADD INDEX idx_transactions_account_date (account_uuid, date, transaction_uuid),
+ADD INDEX idx_transactions_user_date (user_uuid, date, transaction_uuid);
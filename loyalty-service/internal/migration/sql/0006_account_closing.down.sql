@@ -0,0 +1,3 @@
+-- Remove closed_date from accounts. The owners given to accounts that had none are kept.
+ALTER TABLE accounts
+DROP COLUMN closed_date;
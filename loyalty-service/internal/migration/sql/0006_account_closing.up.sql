@@ -0,0 +1,10 @@
+-- Add closed_date to accounts
+ALTER TABLE accounts
+ADD COLUMN closed_date DATETIME;
+
+-- Accounts created before owners were tracked are owned by their longest standing member
+UPDATE accounts a
+SET a.owner_id = (
+    SELECT u.user_uuid FROM users u WHERE u.account_uuid = a.account_uuid ORDER BY u.creation_date LIMIT 1
+)
+WHERE a.owner_id IS NULL;
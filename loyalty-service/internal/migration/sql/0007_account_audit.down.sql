@@ -0,0 +1,2 @@
+-- Drop the account_audit table
+DROP TABLE IF EXISTS account_audit;
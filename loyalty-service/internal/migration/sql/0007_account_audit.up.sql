@@ -0,0 +1,13 @@
+-- Create the account_audit table
+CREATE TABLE IF NOT EXISTS account_audit (
+    audit_uuid CHAR(36) PRIMARY KEY,
+    account_uuid CHAR(36) NOT NULL,
+    actor_uuid CHAR(36),
+    user_uuid CHAR(36),
+    action VARCHAR(32) NOT NULL,
+    points INT DEFAULT 0,
+    detail VARCHAR(255),
+    creation_date DATETIME NOT NULL,
+    INDEX idx_account_audit_account_date (account_uuid, creation_date),
+    CONSTRAINT fk_account_audit_accounts FOREIGN KEY (account_uuid) REFERENCES accounts(account_uuid)
+) ENGINE=NDBCLUSTER;
@@ -0,0 +1,12 @@
+-- Create the idempotency_keys table
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope CHAR(36) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INT DEFAULT 0,
+    response TEXT,
+    creation_date DATETIME NOT NULL,
+    expiry_date DATETIME NOT NULL,
+    PRIMARY KEY (scope, idempotency_key),
+    INDEX idx_idempotency_keys_expiry (expiry_date)
+) ENGINE=NDBCLUSTER;
@@ -0,0 +1,2 @@
+-- Drop the ledger_entries table. accounts.points_balance is kept up to date alongside it, so balances survive.
+DROP TABLE IF EXISTS ledger_entries;
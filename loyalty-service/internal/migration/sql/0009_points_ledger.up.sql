@@ -0,0 +1,25 @@
+-- Create the ledger_entries table, the source of truth for points balances
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    entry_uuid CHAR(36) PRIMARY KEY,
+    journal_uuid CHAR(36) NOT NULL,
+    account_ref VARCHAR(64) NOT NULL,
+    entry_type VARCHAR(20) NOT NULL,
+    points INT NOT NULL,
+    transaction_uuid CHAR(36),
+    description VARCHAR(255),
+    creation_date DATETIME NOT NULL,
+    INDEX idx_ledger_entries_account_date (account_ref, creation_date),
+    INDEX idx_ledger_entries_journal (journal_uuid),
+    INDEX idx_ledger_entries_transaction (transaction_uuid)
+) ENGINE=NDBCLUSTER;
+
+-- Carry existing balances over into the ledger, one opening journal per account
+INSERT INTO ledger_entries (entry_uuid, journal_uuid, account_ref, entry_type, points, description, creation_date)
+SELECT UUID(), account_uuid, account_uuid, 'opening', points_balance, 'balance before the ledger was introduced', NOW()
+FROM accounts
+WHERE points_balance <> 0;
+
+INSERT INTO ledger_entries (entry_uuid, journal_uuid, account_ref, entry_type, points, description, creation_date)
+SELECT UUID(), account_uuid, 'system:opening', 'opening', -points_balance, 'balance before the ledger was introduced', NOW()
+FROM accounts
+WHERE points_balance <> 0;
@@ -0,0 +1,8 @@
+-- Remove refunds and voids from transactions
+ALTER TABLE transactions
+DROP FOREIGN KEY fk_transactions_original;
+
+ALTER TABLE transactions
+DROP INDEX idx_transactions_original,
+DROP COLUMN original_transaction_uuid,
+DROP COLUMN transaction_type;
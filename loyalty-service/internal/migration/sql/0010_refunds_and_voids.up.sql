@@ -0,0 +1,6 @@
+-- Add refunds and voids to transactions
+ALTER TABLE transactions
+ADD COLUMN transaction_type VARCHAR(20) NOT NULL DEFAULT 'purchase',
+ADD COLUMN original_transaction_uuid CHAR(36),
+ADD INDEX idx_transactions_original (original_transaction_uuid),
+ADD CONSTRAINT fk_transactions_original FOREIGN KEY (original_transaction_uuid) REFERENCES transactions(transaction_uuid);
@@ -0,0 +1,5 @@
+-- Remove rule sets
+ALTER TABLE transactions
+DROP COLUMN rule_set_version;
+
+DROP TABLE IF EXISTS rule_sets;
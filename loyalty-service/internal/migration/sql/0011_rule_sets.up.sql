@@ -0,0 +1,12 @@
+-- Create the rule_sets table, versioned earn and burn rules
+CREATE TABLE IF NOT EXISTS rule_sets (
+    version INT PRIMARY KEY,
+    definition TEXT NOT NULL,
+    created_by CHAR(36),
+    creation_date DATETIME NOT NULL,
+    CONSTRAINT fk_rule_sets_users FOREIGN KEY (created_by) REFERENCES users(user_uuid)
+) ENGINE=NDBCLUSTER;
+
+-- Record which rule set each transaction's points were worked out with
+ALTER TABLE transactions
+ADD COLUMN rule_set_version INT;
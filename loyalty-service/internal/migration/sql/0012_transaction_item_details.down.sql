@@ -0,0 +1,7 @@
+-- Remove product details from transaction_items
+ALTER TABLE transaction_items
+DROP INDEX idx_transaction_items_transaction,
+DROP COLUMN unit_price,
+DROP COLUMN quantity,
+DROP COLUMN category,
+DROP COLUMN sku;
@@ -0,0 +1,7 @@
+-- Add product details to transaction_items
+ALTER TABLE transaction_items
+ADD COLUMN sku VARCHAR(64),
+ADD COLUMN category VARCHAR(64),
+ADD COLUMN quantity INT NOT NULL DEFAULT 1,
+ADD COLUMN unit_price DECIMAL(10,2),
+ADD INDEX idx_transaction_items_transaction (transaction_uuid, item_number);
@@ -0,0 +1,14 @@
+-- Remove the rewards catalogue and unlink redemptions from it
+ALTER TABLE points_redemption
+DROP FOREIGN KEY fk_points_redemption_stores,
+DROP FOREIGN KEY fk_points_redemption_rewards,
+DROP FOREIGN KEY fk_points_redemption_accounts;
+
+ALTER TABLE points_redemption
+DROP INDEX idx_points_redemption_account_date,
+DROP INDEX idx_points_redemption_user_date,
+DROP COLUMN store_uuid,
+DROP COLUMN reward_uuid,
+DROP COLUMN account_uuid;
+
+DROP TABLE IF EXISTS rewards;
@@ -0,0 +1,24 @@
+-- Create the rewards table, the catalogue points can be redeemed against
+CREATE TABLE IF NOT EXISTS rewards (
+    reward_uuid CHAR(36) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description VARCHAR(1024),
+    kind VARCHAR(20) NOT NULL,
+    percent_off INT DEFAULT 0,
+    points_cost INT NOT NULL,
+    stock INT,
+    valid_from DATETIME,
+    valid_until DATETIME,
+    creation_date DATETIME NOT NULL
+) ENGINE=NDBCLUSTER;
+
+-- Link redemptions to the account, reward and store
+ALTER TABLE points_redemption
+ADD COLUMN account_uuid CHAR(36),
+ADD COLUMN reward_uuid CHAR(36),
+ADD COLUMN store_uuid CHAR(36),
+ADD INDEX idx_points_redemption_user_date (user_uuid, redemption_date),
+ADD INDEX idx_points_redemption_account_date (account_uuid, redemption_date),
+ADD CONSTRAINT fk_points_redemption_accounts FOREIGN KEY (account_uuid) REFERENCES accounts(account_uuid),
+ADD CONSTRAINT fk_points_redemption_rewards FOREIGN KEY (reward_uuid) REFERENCES rewards(reward_uuid),
+ADD CONSTRAINT fk_points_redemption_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid);
@@ -0,0 +1,3 @@
+-- Stop recording how much of a purchase was paid for with points
+ALTER TABLE transactions
+DROP COLUMN discount;
@@ -0,0 +1,3 @@
+-- Record how much of a purchase was paid for with points
+ALTER TABLE transactions
+ADD COLUMN discount DECIMAL(10,2) DEFAULT 0;
@@ -0,0 +1,5 @@
+-- Remove membership tiers from accounts
+ALTER TABLE accounts
+DROP COLUMN tier_review_date,
+DROP COLUMN tier_grace_until,
+DROP COLUMN tier;
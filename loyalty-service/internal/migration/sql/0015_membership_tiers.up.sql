@@ -0,0 +1,5 @@
+-- Add membership tiers to accounts
+ALTER TABLE accounts
+ADD COLUMN tier VARCHAR(20) NOT NULL DEFAULT 'bronze',
+ADD COLUMN tier_grace_until DATETIME,
+ADD COLUMN tier_review_date DATETIME;
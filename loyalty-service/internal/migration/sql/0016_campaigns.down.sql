@@ -0,0 +1,5 @@
+-- Remove campaigns
+ALTER TABLE transaction_items
+DROP INDEX idx_transaction_items_sku;
+
+DROP TABLE IF EXISTS transaction_campaigns, campaigns;
@@ -0,0 +1,32 @@
+-- Create the campaigns table, time-boxed promotions earning extra points
+CREATE TABLE IF NOT EXISTS campaigns (
+    campaign_uuid CHAR(36) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description VARCHAR(1024),
+    kind VARCHAR(20) NOT NULL,
+    multiplier DECIMAL(6,2) DEFAULT 0,
+    bonus_points INT DEFAULT 0,
+    targeting TEXT NOT NULL,
+    start_date DATETIME NOT NULL,
+    end_date DATETIME,
+    paused_date DATETIME,
+    created_by CHAR(36),
+    creation_date DATETIME NOT NULL,
+    INDEX idx_campaigns_schedule (start_date, end_date),
+    CONSTRAINT fk_campaigns_users FOREIGN KEY (created_by) REFERENCES users(user_uuid)
+) ENGINE=NDBCLUSTER;
+
+-- Create the transaction_campaigns table, the points each campaign added to a purchase
+CREATE TABLE IF NOT EXISTS transaction_campaigns (
+    transaction_uuid CHAR(36) NOT NULL,
+    campaign_uuid CHAR(36) NOT NULL,
+    points INT NOT NULL,
+    PRIMARY KEY (transaction_uuid, campaign_uuid),
+    INDEX idx_transaction_campaigns_campaign (campaign_uuid),
+    CONSTRAINT fk_transaction_campaigns_transactions FOREIGN KEY (transaction_uuid) REFERENCES transactions(transaction_uuid),
+    CONSTRAINT fk_transaction_campaigns_campaigns FOREIGN KEY (campaign_uuid) REFERENCES campaigns(campaign_uuid)
+) ENGINE=NDBCLUSTER;
+
+-- Speed up checking whether an account has bought a product before
+ALTER TABLE transaction_items
+ADD INDEX idx_transaction_items_sku (sku, transaction_uuid);
@@ -0,0 +1,9 @@
+-- Remove trading details and opening hours from stores
+DROP TABLE IF EXISTS store_opening_hours;
+
+ALTER TABLE stores
+DROP INDEX idx_stores_region,
+DROP COLUMN creation_date,
+DROP COLUMN status,
+DROP COLUMN currency,
+DROP COLUMN timezone;
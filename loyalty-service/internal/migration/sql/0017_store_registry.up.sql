@@ -0,0 +1,17 @@
+-- Add trading details to stores
+ALTER TABLE stores
+ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'EUR',
+ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'active',
+ADD COLUMN creation_date DATETIME,
+ADD INDEX idx_stores_region (region);
+
+-- Create the store_opening_hours table
+CREATE TABLE IF NOT EXISTS store_opening_hours (
+    store_uuid CHAR(36) NOT NULL,
+    day CHAR(3) NOT NULL,
+    opens CHAR(5) NOT NULL,
+    closes CHAR(5) NOT NULL,
+    PRIMARY KEY (store_uuid, day, opens),
+    CONSTRAINT fk_store_opening_hours_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid)
+) ENGINE=NDBCLUSTER;
@@ -0,0 +1 @@
+-- Nothing to undo, accounts without a region were in the default region all along
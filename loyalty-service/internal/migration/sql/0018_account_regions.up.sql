@@ -0,0 +1,4 @@
+-- Accounts created before regions were configured live in the default region
+UPDATE accounts
+SET region = 'default'
+WHERE region IS NULL OR region = '';
@@ -0,0 +1,3 @@
+-- Stop recording when accounts last changed
+ALTER TABLE accounts
+DROP COLUMN last_write_date;
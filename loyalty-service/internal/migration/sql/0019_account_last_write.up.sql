@@ -0,0 +1,3 @@
+-- When an account, its balance, history or members last changed, so reads about it can avoid replicas for a while
+ALTER TABLE accounts
+ADD COLUMN last_write_date DATETIME(3);
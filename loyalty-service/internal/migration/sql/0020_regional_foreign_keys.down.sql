@@ -0,0 +1,25 @@
+-- Put the foreign keys to data kept in the default region back. Outside the default region this
+-- fails as soon as any row refers to a store, reward or campaign, which is why they were dropped.
+ALTER TABLE campaigns
+ADD CONSTRAINT fk_campaigns_users FOREIGN KEY (created_by) REFERENCES users(user_uuid);
+
+ALTER TABLE rule_sets
+ADD CONSTRAINT fk_rule_sets_users FOREIGN KEY (created_by) REFERENCES users(user_uuid);
+
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE transaction_campaigns ADD CONSTRAINT fk_transaction_campaigns_campaigns FOREIGN KEY (campaign_uuid) REFERENCES campaigns(campaign_uuid)');
+PREPARE add_foreign_keys FROM @statement;
+EXECUTE add_foreign_keys;
+
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE points_redemption ADD CONSTRAINT fk_points_redemption_rewards FOREIGN KEY (reward_uuid) REFERENCES rewards(reward_uuid), ADD CONSTRAINT fk_points_redemption_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid)');
+PREPARE add_foreign_keys FROM @statement;
+EXECUTE add_foreign_keys;
+
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE users ADD CONSTRAINT fk_users_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid)');
+PREPARE add_foreign_keys FROM @statement;
+EXECUTE add_foreign_keys;
+
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE transactions ADD CONSTRAINT fk_transactions_stores FOREIGN KEY (store_uuid) REFERENCES stores(store_uuid)');
+PREPARE add_foreign_keys FROM @statement;
+EXECUTE add_foreign_keys;
+
+DEALLOCATE PREPARE add_foreign_keys;
@@ -0,0 +1,36 @@
+-- Stores, rewards, campaigns and rule sets are kept in the default region only, so outside it the
+-- foreign keys from a region's own rows to them can never be met. The services check those
+-- references against the default region instead. @region is the region being migrated.
+
+-- Purchases and staff are at stores
+SET @statement = IF(@region = 'default', 'DO 0', (
+    SELECT COALESCE(CONCAT('ALTER TABLE transactions DROP FOREIGN KEY ', MIN(constraint_name)), 'DO 0')
+    FROM information_schema.key_column_usage
+    WHERE table_schema = DATABASE() AND table_name = 'transactions' AND column_name = 'store_uuid' AND referenced_table_name = 'stores'
+));
+PREPARE drop_foreign_keys FROM @statement;
+EXECUTE drop_foreign_keys;
+
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE users DROP FOREIGN KEY fk_users_stores');
+PREPARE drop_foreign_keys FROM @statement;
+EXECUTE drop_foreign_keys;
+
+-- Redemptions are of rewards, at stores
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE points_redemption DROP FOREIGN KEY fk_points_redemption_rewards, DROP FOREIGN KEY fk_points_redemption_stores');
+PREPARE drop_foreign_keys FROM @statement;
+EXECUTE drop_foreign_keys;
+
+-- Purchases earn points from campaigns
+SET @statement = IF(@region = 'default', 'DO 0', 'ALTER TABLE transaction_campaigns DROP FOREIGN KEY fk_transaction_campaigns_campaigns');
+PREPARE drop_foreign_keys FROM @statement;
+EXECUTE drop_foreign_keys;
+
+DEALLOCATE PREPARE drop_foreign_keys;
+
+-- Rule sets and campaigns are created by admins, whose users are in the region of their own
+-- account, which may not be the default region
+ALTER TABLE rule_sets
+DROP FOREIGN KEY fk_rule_sets_users;
+
+ALTER TABLE campaigns
+DROP FOREIGN KEY fk_campaigns_users;
@@ -4,10 +4,24 @@ import (
 	"time"
 )
 
+// Membership tiers, from lowest to highest.
+const (
+	TierBronze = "bronze"
+	TierSilver = "silver"
+	TierGold   = "gold"
+)
+
 // Account represents a loyalty group account
 type Account struct {
-	ID           string `gorm:"column:account_uuid"`
-	Users        []User
-	Points       int       `gorm:"column:points_balance"`
-	CreationDate time.Time `gorm:"autoCreateTime"`
+	ID             string  `gorm:"column:account_uuid"`
+	OwnerID        *string `gorm:"column:owner_id"` // member who can invite, remove members and close the account
+	Users          []User
+	Points         int        `gorm:"column:points_balance"`
+	CreationDate   time.Time  `gorm:"autoCreateTime"`
+	ClosedDate     *time.Time `gorm:"column:closed_date"`
+	Region         string     `gorm:"column:region"` // home region, whose database cluster holds the account's data
+	Tier           string     `gorm:"column:tier;default:bronze"`
+	TierGraceUntil *time.Time `gorm:"column:tier_grace_until"` // the account keeps its tier until then despite spending too little
+	TierReviewDate *time.Time `gorm:"column:tier_review_date"` // when the tier was last worked out
+	LastWriteDate  *time.Time `gorm:"column:last_write_date"`  // when its balance, history or members last changed
 }
@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// Membership changes recorded in the account audit log.
+const (
+	AuditMemberJoined         = "member_joined"
+	AuditMemberLeft           = "member_left"
+	AuditMemberRemoved        = "member_removed"
+	AuditOwnershipTransferred = "ownership_transferred"
+	AuditAccountClosed        = "account_closed"
+)
+
+// AuditEntry records a change to who is on an account.
+type AuditEntry struct {
+	ID           string    `gorm:"primaryKey;column:audit_uuid"`
+	AccountID    string    `gorm:"not null;column:account_uuid"`
+	ActorID      *string   `gorm:"column:actor_uuid"` // who made the change, nil for the system
+	UserID       *string   `gorm:"column:user_uuid"`  // member the change is about
+	Action       string    `gorm:"not null;column:action"`
+	Points       int       `gorm:"column:points"` // points that moved because of the change
+	Detail       string    `gorm:"column:detail"`
+	CreationDate time.Time `gorm:"not null;column:creation_date"`
+}
+
+// TableName sets the table name for audit entries.
+func (AuditEntry) TableName() string {
+	return "account_audit"
+}
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// Kinds of promotional campaign.
+const (
+	CampaignMultiplier = "multiplier" // multiplies the points earned on the purchases it targets, e.g. double points
+	CampaignBonus      = "bonus"      // adds a fixed number of points to each purchase it targets
+)
+
+// Campaign is a time-boxed promotion that earns members extra points on top of the rule set in force.
+type Campaign struct {
+	ID           string     `gorm:"primaryKey;column:campaign_uuid"`
+	Name         string     `gorm:"not null;column:name"`
+	Description  string     `gorm:"column:description"`
+	Kind         string     `gorm:"not null;column:kind"`
+	Multiplier   float64    `gorm:"column:multiplier"`          // multiplier campaigns only
+	BonusPoints  int        `gorm:"column:bonus_points"`        // bonus campaigns only
+	Targeting    string     `gorm:"not null;column:targeting"`  // JSON encoded campaign.Targeting
+	StartDate    time.Time  `gorm:"not null;column:start_date"` // when the campaign starts
+	EndDate      *time.Time `gorm:"column:end_date"`            // when it ends, nil to run until it is ended by hand
+	PausedDate   *time.Time `gorm:"column:paused_date"`         // set while the campaign is paused
+	CreatedBy    *string    `gorm:"column:created_by"`          // admin who created it
+	CreationDate time.Time  `gorm:"not null;column:creation_date"`
+}
+
+// TableName sets the table name for campaigns.
+func (Campaign) TableName() string {
+	return "campaigns"
+}
+
+// TransactionCampaign records the points a campaign added to a purchase.
+type TransactionCampaign struct {
+	TransactionID string `gorm:"primaryKey;column:transaction_uuid"`
+	CampaignID    string `gorm:"primaryKey;column:campaign_uuid"`
+	Points        int    `gorm:"column:points"`
+}
+
+// TableName sets the table name for campaign contributions.
+func (TransactionCampaign) TableName() string {
+	return "transaction_campaigns"
+}
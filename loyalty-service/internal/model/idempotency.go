@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// IdempotencyKey remembers the response to a request sent with an Idempotency-Key header,
+// so a client retrying the same request gets the same answer instead of repeating it.
+type IdempotencyKey struct {
+	Scope        string    `gorm:"primaryKey;column:scope"` // user or terminal the key belongs to
+	Key          string    `gorm:"primaryKey;column:idempotency_key"`
+	Fingerprint  string    `gorm:"not null;column:fingerprint"` // hash of the request the key was first used with
+	StatusCode   int       `gorm:"column:status_code"`          // 0 while the request is still being handled
+	Response     string    `gorm:"column:response"`
+	CreationDate time.Time `gorm:"not null;column:creation_date"`
+	ExpiryDate   time.Time `gorm:"not null;column:expiry_date"`
+}
+
+// TableName sets the table name for idempotency keys.
+func (IdempotencyKey) TableName() string {
+	return "idempotency_keys"
+}
@@ -7,7 +7,7 @@ type Invitation struct {
 	Email          string    `gorm:"not null;column:email"`
 	AccountUUID    string    `gorm:"column:account_uuid"`
 	InviterUUID    string    `gorm:"column:inviter_uuid"`
-	Token          string    `gorm:"unique;not null;column:token"`
+	Token          string    `gorm:"size:16;unique;not null;column:token"`
 	CreationDate   time.Time `gorm:"not null;column:creation_date"`
 	ExpirationDate time.Time `gorm:"not null;column:expiration_date"`
 	Status         string    `gorm:"not null;column:status"`
@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+// Kinds of ledger entries.
+const (
+	LedgerEarn       = "earn"       // points earned on a purchase
+	LedgerBurn       = "burn"       // points spent on a purchase
+	LedgerAdjustment = "adjustment" // points added or removed by hand, or given when an account is created
+	LedgerExpiry     = "expiry"     // points that expired or were forfeited when an account was closed
+	LedgerTransfer   = "transfer"   // points moved from one account to another
+	LedgerRefund     = "refund"     // points earned or spent on a purchase given back when it is refunded or voided
+	LedgerOpening    = "opening"    // balances carried over from before the ledger existed
+)
+
+// LedgerEntry is one leg of a double-entry posting. Every posting (journal) has at least two
+// entries whose points add up to zero, so points are only ever moved and never appear or vanish.
+//
+// AccountRef is either a loyalty account's UUID or the name of a system account, such as
+// "system:issued", that stands for points entering or leaving circulation.
+type LedgerEntry struct {
+	ID            string    `gorm:"primaryKey;column:entry_uuid"`
+	JournalID     string    `gorm:"not null;column:journal_uuid"`
+	AccountRef    string    `gorm:"not null;column:account_ref"`
+	EntryType     string    `gorm:"not null;column:entry_type"`
+	Points        int       `gorm:"not null;column:points"`  // positive credits the account, negative debits it
+	TransactionID *string   `gorm:"column:transaction_uuid"` // purchase that caused the entry, if any
+	Description   string    `gorm:"column:description"`
+	CreationDate  time.Time `gorm:"not null;column:creation_date"`
+}
+
+// TableName sets the table name for ledger entries.
+func (LedgerEntry) TableName() string {
+	return "ledger_entries"
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// SchemaMigration records a version of the schema applied to the database. A migration is dirty
+// while it is being applied or rolled back, and stays so if it fails part way through.
+type SchemaMigration struct {
+	Version     int       `gorm:"primaryKey;autoIncrement:false;column:version"`
+	Name        string    `gorm:"not null;column:name"`
+	Checksum    string    `gorm:"not null;column:checksum"` // SHA-256 of the migration's up script
+	Dirty       bool      `gorm:"not null;column:dirty"`
+	AppliedDate time.Time `gorm:"not null;column:applied_date"`
+}
+
+// TableName sets the table name for schema migrations.
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
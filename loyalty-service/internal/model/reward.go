@@ -0,0 +1,45 @@
+package model
+
+import "time"
+
+// Kinds of reward in the catalogue.
+const (
+	RewardFreeItem   = "free_item"   // a product on the house, e.g. a coffee or a pastry
+	RewardPercentOff = "percent_off" // a percentage off the next purchase
+)
+
+// Reward is an item of the rewards catalogue that members can spend their points on.
+type Reward struct {
+	ID           string     `gorm:"primaryKey;column:reward_uuid"`
+	Name         string     `gorm:"not null;column:name"`
+	Description  string     `gorm:"column:description"`
+	Kind         string     `gorm:"not null;column:kind"`
+	PercentOff   int        `gorm:"column:percent_off"` // percent_off rewards only
+	PointsCost   int        `gorm:"not null;column:points_cost"`
+	Stock        *int       `gorm:"column:stock"` // how many are left, nil for unlimited
+	ValidFrom    *time.Time `gorm:"column:valid_from"`
+	ValidUntil   *time.Time `gorm:"column:valid_until"`
+	CreationDate time.Time  `gorm:"not null;column:creation_date"`
+}
+
+// TableName sets the table name for rewards.
+func (Reward) TableName() string {
+	return "rewards"
+}
+
+// Redemption records points spent on a reward.
+type Redemption struct {
+	ID                string    `gorm:"primaryKey;column:redemption_uuid"`
+	UserID            string    `gorm:"column:user_uuid"`    // member the reward was given to
+	AccountID         string    `gorm:"column:account_uuid"` // account the points came from
+	RewardID          *string   `gorm:"column:reward_uuid"`
+	StoreID           *string   `gorm:"column:store_uuid"` // store it was redeemed at, nil when redeemed in the app
+	RedemptionDate    time.Time `gorm:"column:redemption_date"`
+	PointsUsed        int       `gorm:"column:points_used"`
+	RewardDescription string    `gorm:"column:reward_description"`
+}
+
+// TableName maps redemptions onto the points_redemption table.
+func (Redemption) TableName() string {
+	return "points_redemption"
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// RuleSet is a published version of the rules that decide how many points purchases earn and
+// how many points a discount costs. Rule sets are never changed once published, a new version
+// is published instead, so every transaction can record the version it was worked out with.
+type RuleSet struct {
+	Version      int       `gorm:"primaryKey;autoIncrement:false;column:version"`
+	Definition   string    `gorm:"not null;column:definition"` // JSON encoded rules.Definition
+	CreatedBy    *string   `gorm:"column:created_by"`
+	CreationDate time.Time `gorm:"not null;column:creation_date"`
+}
+
+// TableName sets the table name for rule sets.
+func (RuleSet) TableName() string {
+	return "rule_sets"
+}
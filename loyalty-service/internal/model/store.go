@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// Store statuses.
+const (
+	StoreActive    = "active"    // trading, purchases can be recorded
+	StoreSuspended = "suspended" // temporarily not trading, e.g. during a refit
+	StoreClosed    = "closed"    // closed for good, kept for the purchases made there
+)
+
+// Store is a cafe of the chain.
+type Store struct {
+	ID           string         `gorm:"primaryKey;column:store_uuid"`
+	Name         string         `gorm:"column:name"`
+	Region       string         `gorm:"column:region"`
+	Timezone     string         `gorm:"column:timezone;default:UTC"` // IANA zone the opening hours are in
+	Currency     string         `gorm:"column:currency;default:EUR"` // ISO 4217 code of the currency amounts are taken in
+	Status       string         `gorm:"column:status;default:active"`
+	OpeningHours []OpeningHours `gorm:"foreignKey:StoreID;references:ID"`
+	CreationDate *time.Time     `gorm:"column:creation_date"` // nil for stores added before the registry
+}
+
+// TableName sets the table name for stores.
+func (Store) TableName() string {
+	return "stores"
+}
+
+// OpeningHours is a period a store is open on a day of the week. A store can open more than once a day.
+type OpeningHours struct {
+	StoreID string `gorm:"primaryKey;column:store_uuid"`
+	Day     string `gorm:"primaryKey;column:day"`   // mon, tue, wed, thu, fri, sat or sun
+	Opens   string `gorm:"primaryKey;column:opens"` // HH:MM in the store's time zone
+	Closes  string `gorm:"column:closes"`           // HH:MM, before Opens when open past midnight
+}
+
+// TableName sets the table name for opening hours.
+func (OpeningHours) TableName() string {
+	return "store_opening_hours"
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// RoleTerminal is the role given to requests signed by a point-of-sale terminal.
+// It identifies a machine rather than a person and can't be assigned to users.
+const RoleTerminal = "pos_terminal"
+
+// Terminal represents a point-of-sale till registered to a store.
+type Terminal struct {
+	ID             string     `gorm:"primaryKey;column:terminal_uuid"`
+	StoreID        string     `gorm:"not null;column:store_uuid"`
+	Name           string     `gorm:"column:name"`
+	KeyID          string     `gorm:"unique;not null;column:key_id"` // public half of the terminal's API key
+	CreationDate   time.Time  `gorm:"not null;column:creation_date"`
+	RotationDate   *time.Time `gorm:"column:rotation_date"`
+	RevocationDate *time.Time `gorm:"column:revocation_date"`
+}
+
+// TableName keeps terminals apart from anything else that might be called a terminal.
+func (Terminal) TableName() string {
+	return "pos_terminals"
+}
@@ -4,12 +4,26 @@ import (
 	"time"
 )
 
+// Kinds of transaction.
+const (
+	TransactionPurchase = "purchase"
+	TransactionRefund   = "refund" // money given back for some or all of a purchase
+	TransactionVoid     = "void"   // a purchase cancelled shortly after it was recorded
+)
+
 // Transaction represents a transaction in the loyalty service system.
 type Transaction struct {
-	ID           string    `gorm:"column:transaction_uuid"` // unique ID
-	AccountID    string    `gorm:"column:account_uuid"`
-	UserID       string    `gorm:"column:user_uuid"` // ID of the user who made the transaction
-	Amount       float64   // Transaction amount
-	Date         time.Time `gorm:"autoCreateTime"`
-	PointsEarned int
+	ID                    string    `gorm:"column:transaction_uuid"` // unique ID
+	AccountID             string    `gorm:"column:account_uuid"`
+	UserID                string    `gorm:"column:user_uuid"`                         // ID of the user who made the transaction
+	StoreID               *string   `gorm:"column:store_uuid"`                        // store where the transaction took place
+	Type                  string    `gorm:"column:transaction_type;default:purchase"` // TransactionPurchase, TransactionRefund or TransactionVoid
+	OriginalTransactionID *string   `gorm:"column:original_transaction_uuid"`         // purchase a refund or void reverses
+	Amount                float64   // Transaction amount, negative for refunds and voids
+	Date                  time.Time `gorm:"autoCreateTime"`
+	PointsEarned          int
+	Discount              float64               `gorm:"column:discount"`                        // money taken off the amount by spending points
+	RuleSetVersion        *int                  `gorm:"column:rule_set_version"`                // rule set the points were worked out with
+	Items                 []TransactionItem     `gorm:"foreignKey:TransactionID;references:ID"` // basket of an itemised purchase
+	Campaigns             []TransactionCampaign `gorm:"foreignKey:TransactionID;references:ID"` // campaigns that added to PointsEarned
 }
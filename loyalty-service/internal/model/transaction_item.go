@@ -0,0 +1,14 @@
+package model
+
+// TransactionItem is one line of an itemised purchase.
+type TransactionItem struct {
+	ID            string  `gorm:"primaryKey;column:transaction_item_uuid"`
+	TransactionID string  `gorm:"column:transaction_uuid"`
+	ItemNumber    int     `gorm:"column:item_number"` // position of the line on the receipt, from 1
+	SKU           string  `gorm:"column:sku"`
+	Name          string  `gorm:"column:item"`
+	Category      string  `gorm:"column:category"` // product category, used by the earn rules
+	Quantity      int     `gorm:"column:quantity"`
+	UnitPrice     float64 `gorm:"column:unit_price"`
+	Amount        float64 `gorm:"column:amount"` // Quantity * UnitPrice
+}
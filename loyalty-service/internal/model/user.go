@@ -4,6 +4,14 @@ import (
 	"time"
 )
 
+// Roles a user can have. Customers are the default; staff and managers belong to a store.
+const (
+	RoleCustomer     = "customer"
+	RoleStoreStaff   = "store_staff"
+	RoleStoreManager = "store_manager"
+	RoleAdmin        = "admin"
+)
+
 // User represents a user in the loyalty service system.
 type User struct {
 	ID           string  `gorm:"column:user_uuid"`
@@ -12,7 +20,19 @@ type User struct {
 	Name         string
 	Email        string `gorm:"unique;column:email_address"`
 	Password     string
-	Phone        string    `gorm:"unique;column:phone_number"`
+	Phone        string    `gorm:"column:phone_number"` // not unique in the schema, users may leave it empty
 	CreationDate time.Time `gorm:"autoCreateTime"`
-	InviteCode   *string   `gorm:"uniqueIndex;"`
+	InviteCode   *string   `gorm:"unique;column:invite_code"`
+	Role         string    `gorm:"column:role;default:customer"`
+	StoreID      *string   `gorm:"column:store_uuid"` // store the user works at, staff and managers only
+}
+
+// IsStoreRole reports whether the role belongs to someone working at a store.
+func IsStoreRole(role string) bool {
+	return role == RoleStoreStaff || role == RoleStoreManager
+}
+
+// IsValidRole reports whether the role is one of the known roles.
+func IsValidRole(role string) bool {
+	return role == RoleCustomer || role == RoleAdmin || IsStoreRole(role)
 }
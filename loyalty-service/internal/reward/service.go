@@ -0,0 +1,272 @@
+package reward
+
+import (
+	"context"
+	"errors"
+	"log"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/model"
+	"loyalty-service/pkg/db"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvalidReward is returned when a reward is missing details or has an impossible cost or discount.
+	ErrInvalidReward = errors.New("a reward needs a name, a kind, a positive points cost and, to take a percentage off, a percentage between 1 and 100")
+	// ErrRewardUnavailable is returned when redeeming a reward outside of its validity period.
+	ErrRewardUnavailable = errors.New("reward is not available")
+	// ErrOutOfStock is returned when redeeming a reward that has run out.
+	ErrOutOfStock = errors.New("reward is out of stock")
+	// ErrNoAccount is returned when redeeming a reward for a user who doesn't belong to an account.
+	ErrNoAccount = errors.New("user doesn't belong to a loyalty account")
+)
+
+// Service manages the rewards catalogue and the points members spend on it.
+type Service struct {
+	db        *gorm.DB
+	ledgerSvc *ledger.Service
+}
+
+// NewService creates a new reward service.
+func NewService(db *gorm.DB, ledgerSvc *ledger.Service) *Service {
+	return &Service{
+		db:        db,
+		ledgerSvc: ledgerSvc,
+	}
+}
+
+// CreateReward adds a reward to the catalogue.
+func (s *Service) CreateReward(ctx context.Context, reward model.Reward) (*model.Reward, error) {
+	if err := validate(&reward); err != nil {
+		return nil, err
+	}
+
+	rewardID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	reward.ID = rewardID.String()
+	reward.CreationDate = time.Now()
+
+	if err := s.db.WithContext(ctx).Create(&reward).Error; err != nil {
+		return nil, err
+	}
+
+	return &reward, nil
+}
+
+// UpdateReward replaces a reward's details. Past redemptions keep the cost and description they had.
+func (s *Service) UpdateReward(ctx context.Context, rewardID string, changes model.Reward) (*model.Reward, error) {
+	if err := validate(&changes); err != nil {
+		return nil, err
+	}
+
+	reward, err := s.GetReward(ctx, rewardID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.WithContext(ctx).Model(reward).
+		Select("name", "description", "kind", "percent_off", "points_cost", "stock", "valid_from", "valid_until").
+		Updates(&changes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	changes.ID = reward.ID
+	changes.CreationDate = reward.CreationDate
+	return &changes, nil
+}
+
+// WithdrawReward takes a reward out of the catalogue from now on.
+func (s *Service) WithdrawReward(ctx context.Context, rewardID string) (*model.Reward, error) {
+	reward, err := s.GetReward(ctx, rewardID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := s.db.WithContext(ctx).Model(reward).Update("valid_until", now).Error; err != nil {
+		return nil, err
+	}
+
+	reward.ValidUntil = &now
+	return reward, nil
+}
+
+// GetReward retrieves a reward by its ID.
+func (s *Service) GetReward(ctx context.Context, rewardID string) (*model.Reward, error) {
+	var reward model.Reward
+	if err := s.db.WithContext(ctx).First(&reward, "reward_uuid = ?", rewardID).Error; err != nil {
+		return nil, err
+	}
+
+	return &reward, nil
+}
+
+// GetRewards lists the catalogue, cheapest first. Unless all is set, only rewards that can be
+// redeemed right now are included.
+func (s *Service) GetRewards(ctx context.Context, all bool) ([]model.Reward, error) {
+	query := s.db.WithContext(ctx)
+	if !all {
+		now := time.Now()
+		query = query.
+			Where("valid_from IS NULL OR valid_from <= ?", now).
+			Where("valid_until IS NULL OR valid_until > ?", now).
+			Where("stock IS NULL OR stock > 0")
+	}
+
+	var rewards []model.Reward
+	if err := query.Order("points_cost").Order("name").Find(&rewards).Error; err != nil {
+		return nil, err
+	}
+
+	return rewards, nil
+}
+
+// Redeem spends a member's account points on a reward. storeID is the store it is redeemed at,
+// nil when the member redeems it themselves.
+func (s *Service) Redeem(ctx context.Context, rewardID, userID string, storeID *string) (*model.Redemption, error) {
+	reward, err := s.reserve(ctx, rewardID)
+	if err != nil {
+		return nil, err
+	}
+
+	var redemption model.Redemption
+	now := time.Now()
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user model.User
+		if err := tx.First(&user, "user_uuid = ?", userID).Error; err != nil {
+			return err
+		}
+		if user.AccountID == nil {
+			return ErrNoAccount
+		}
+
+		redemptionID, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+
+		redemption = model.Redemption{
+			ID:                redemptionID.String(),
+			UserID:            userID,
+			AccountID:         *user.AccountID,
+			RewardID:          &reward.ID,
+			StoreID:           storeID,
+			RedemptionDate:    now,
+			PointsUsed:        reward.PointsCost,
+			RewardDescription: reward.Name,
+		}
+		if err := tx.Create(&redemption).Error; err != nil {
+			return err
+		}
+
+		// Fails with ledger.ErrInsufficientPoints if the account can't afford it
+		return s.ledgerSvc.Post(tx, model.LedgerBurn, redemption.AccountID, -reward.PointsCost, nil,
+			"redeemed "+reward.Name+" ("+redemption.ID+")")
+	})
+	if err != nil {
+		s.unreserve(reward)
+		return nil, err
+	}
+
+	return &redemption, nil
+}
+
+// reserve checks a reward can be redeemed and takes one out of its stock. The catalogue is shared
+// by every region and lives in the default one, so the stock is taken in a transaction of its own
+// there before the points are spent in the member's region, see unreserve.
+func (s *Service) reserve(ctx context.Context, rewardID string) (*model.Reward, error) {
+	var reward model.Reward
+
+	err := s.db.WithContext(db.WithRegion(ctx, db.DefaultRegion)).Transaction(func(tx *gorm.DB) error {
+		// Lock the reward so the last one in stock can only be redeemed once
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&reward, "reward_uuid = ?", rewardID).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if (reward.ValidFrom != nil && now.Before(*reward.ValidFrom)) || (reward.ValidUntil != nil && !now.Before(*reward.ValidUntil)) {
+			return ErrRewardUnavailable
+		}
+		if reward.Stock == nil {
+			return nil
+		}
+		if *reward.Stock <= 0 {
+			return ErrOutOfStock
+		}
+
+		return tx.Model(&reward).Update("stock", gorm.Expr("stock - 1")).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &reward, nil
+}
+
+// unreserve puts back a reward taken out of stock for a redemption that failed. It uses a fresh
+// context, the request's may be why the redemption failed.
+func (s *Service) unreserve(reward *model.Reward) {
+	if reward.Stock == nil {
+		return
+	}
+
+	ctx := db.WithRegion(context.Background(), db.DefaultRegion)
+	err := s.db.WithContext(ctx).Model(&model.Reward{}).Where("reward_uuid = ?", reward.ID).
+		Update("stock", gorm.Expr("stock + 1")).Error
+	if err != nil {
+		log.Printf("Error putting reward %s back in stock: %v", reward.ID, err)
+	}
+}
+
+// GetRedemptionsByUserID lists the rewards a user has redeemed, newest first.
+func (s *Service) GetRedemptionsByUserID(ctx context.Context, userID string) ([]model.Redemption, error) {
+	return s.redemptions(ctx, "user_uuid = ?", userID)
+}
+
+// GetRedemptionsByAccountID lists the rewards redeemed with an account's points, newest first.
+func (s *Service) GetRedemptionsByAccountID(ctx context.Context, accountID string) ([]model.Redemption, error) {
+	return s.redemptions(ctx, "account_uuid = ?", accountID)
+}
+
+func (s *Service) redemptions(ctx context.Context, owner, ownerID string) ([]model.Redemption, error) {
+	var redemptions []model.Redemption
+	err := s.db.WithContext(ctx).Where(owner, ownerID).Order("redemption_date DESC").Find(&redemptions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return redemptions, nil
+}
+
+func validate(reward *model.Reward) error {
+	if reward.Name == "" || reward.PointsCost <= 0 || (reward.Stock != nil && *reward.Stock < 0) {
+		return ErrInvalidReward
+	}
+
+	switch reward.Kind {
+	case model.RewardFreeItem:
+		reward.PercentOff = 0
+	case model.RewardPercentOff:
+		if reward.PercentOff < 1 || reward.PercentOff > 100 {
+			return ErrInvalidReward
+		}
+	default:
+		return ErrInvalidReward
+	}
+
+	if reward.ValidFrom != nil && reward.ValidUntil != nil && !reward.ValidFrom.Before(*reward.ValidUntil) {
+		return ErrInvalidReward
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	// Rule sets name their time zone, make sure every zone can be loaded even if the host has no zoneinfo
+	_ "time/tzdata"
+)
+
+// Default rates, used until the first rule set is published.
+const (
+	DefaultEarnRate = 1  // points per euro spent
+	DefaultBurnRate = 10 // points per euro of discount
+)
+
+// ErrInvalidRuleSet is wrapped by every error describing what is wrong with a rule set.
+var ErrInvalidRuleSet = errors.New("invalid rule set")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Definition is the content of a rule set.
+type Definition struct {
+	EarnRate float64 `json:"earnRate"`           // points per euro spent before any rule applies
+	BurnRate float64 `json:"burnRate"`           // points it costs to take a euro off a purchase
+	Timezone string  `json:"timezone,omitempty"` // IANA zone of days and times for purchases whose store's zone isn't known, UTC by default
+	Rules    []Rule  `json:"rules"`
+}
+
+// Rule multiplies the points earned on the lines of a purchase it matches. Empty conditions match
+// everything. When several rules match a line, the largest multiplier applies. Days and times
+// of day are local to the store the purchase is made at.
+type Rule struct {
+	Name       string   `json:"name"`
+	Stores     []string `json:"stores,omitempty"`
+	Regions    []string `json:"regions,omitempty"`
+	Categories []string `json:"categories,omitempty"` // product categories
+	SKUs       []string `json:"skus,omitempty"`       // products
+	Tiers      []string `json:"tiers,omitempty"`      // member tiers
+	Days       []string `json:"days,omitempty"`       // mon, tue, wed, thu, fri, sat or sun
+	From       string   `json:"from,omitempty"`       // HH:MM, inclusive
+	To         string   `json:"to,omitempty"`         // HH:MM, exclusive. Before From for windows that span midnight
+	Multiplier float64  `json:"multiplier"`           // 0 earns nothing, e.g. to exclude a category
+}
+
+// Line is a part of a purchase that earns points on its own, such as one item of a basket.
+type Line struct {
+	Amount   float64
+	SKU      string
+	Category string
+}
+
+// Purchase is everything about a purchase the rules can depend on.
+type Purchase struct {
+	StoreID        string
+	Region         string
+	Tier           string
+	TierMultiplier float64 // the tier's own earn multiplier, applied on top of the rules. 0 counts as 1
+	Timezone       string  // IANA zone of the store, whose local time days and times of day are matched against
+	Time           time.Time
+	Lines          []Line
+}
+
+// DefaultDefinition is what purchases are worked out with before any rule set is published.
+func DefaultDefinition() Definition {
+	return Definition{
+		EarnRate: DefaultEarnRate,
+		BurnRate: DefaultBurnRate,
+		Rules:    []Rule{},
+	}
+}
+
+// Validate checks that a definition can be evaluated.
+func (d *Definition) Validate() error {
+	if d.EarnRate < 0 || math.IsNaN(d.EarnRate) || math.IsInf(d.EarnRate, 0) {
+		return fmt.Errorf("%w: earnRate can't be negative", ErrInvalidRuleSet)
+	}
+	if d.BurnRate <= 0 || math.IsNaN(d.BurnRate) || math.IsInf(d.BurnRate, 0) {
+		return fmt.Errorf("%w: burnRate must be positive", ErrInvalidRuleSet)
+	}
+	if _, err := d.location(); err != nil {
+		return fmt.Errorf("%w: unknown timezone %q", ErrInvalidRuleSet, d.Timezone)
+	}
+
+	for i, rule := range d.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("%w: rule %d: %v", ErrInvalidRuleSet, i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that a rule's conditions and multiplier make sense.
+func (r *Rule) Validate() error {
+	if r.Multiplier < 0 || math.IsNaN(r.Multiplier) || math.IsInf(r.Multiplier, 0) {
+		return errors.New("multiplier can't be negative")
+	}
+	for _, day := range r.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+	if (r.From == "") != (r.To == "") {
+		return errors.New("from and to must be given together")
+	}
+	if r.From != "" {
+		if _, err := minuteOfDay(r.From); err != nil {
+			return errors.New("from must be HH:MM")
+		}
+		if _, err := minuteOfDay(r.To); err != nil {
+			return errors.New("to must be HH:MM")
+		}
+	}
+
+	return nil
+}
+
+// Earn works out the points a purchase earns, rounded down to a whole point.
+func (d *Definition) Earn(purchase Purchase) int {
+	points := 0.0
+	for _, linePoints := range d.LinePoints(purchase) {
+		points += linePoints
+	}
+
+	return Floor(points)
+}
+
+// LinePoints works out the points each line of a purchase earns, tier multiplier included and
+// not yet rounded.
+func (d *Definition) LinePoints(purchase Purchase) []float64 {
+	at := purchase.LocalTime(d.Timezone)
+
+	tierMultiplier := 1.0
+	if purchase.TierMultiplier > 0 {
+		tierMultiplier = purchase.TierMultiplier
+	}
+
+	points := make([]float64, len(purchase.Lines))
+	for i, line := range purchase.Lines {
+		multiplier := 1.0
+		matched := false
+		for _, rule := range d.Rules {
+			if rule.Matches(purchase, line, at) && (!matched || rule.Multiplier > multiplier) {
+				multiplier = rule.Multiplier
+				matched = true
+			}
+		}
+
+		points[i] = line.Amount * d.EarnRate * multiplier * tierMultiplier
+	}
+
+	return points
+}
+
+// LocalTime is when a purchase was made on the clock of its store, or in zone if the store's time
+// zone isn't known. Anything that can't be loaded counts as UTC.
+func (p *Purchase) LocalTime(zone string) time.Time {
+	for _, name := range []string{p.Timezone, zone} {
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return p.Time.In(loc)
+		}
+	}
+	return p.Time.UTC()
+}
+
+// Floor rounds points down to a whole point.
+func Floor(points float64) int {
+	// Tiny amount of slack so 3 * 1.1 doesn't round down to 3.29999...
+	return int(math.Floor(points + 1e-9))
+}
+
+// Cost works out how many points it takes to knock amount off a purchase, rounded up to a whole point.
+func (d *Definition) Cost(amount float64) int {
+	return int(math.Ceil(amount*d.BurnRate - 1e-9))
+}
+
+// Discount works out how much money points take off a purchase, rounded down to the cent.
+func (d *Definition) Discount(points int) float64 {
+	return math.Floor(float64(points)/d.BurnRate*100+1e-9) / 100
+}
+
+func (d *Definition) location() (*time.Location, error) {
+	if d.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(d.Timezone)
+}
+
+// Matches reports whether a rule applies to a line of a purchase made at the time at, already in the
+// rule's time zone.
+func (r *Rule) Matches(purchase Purchase, line Line, at time.Time) bool {
+	if !contains(r.Stores, purchase.StoreID) || !contains(r.Regions, purchase.Region) ||
+		!contains(r.Categories, line.Category) || !contains(r.SKUs, line.SKU) || !contains(r.Tiers, purchase.Tier) {
+		return false
+	}
+
+	if len(r.Days) > 0 {
+		onDay := false
+		for _, day := range r.Days {
+			if weekdays[strings.ToLower(day)] == at.Weekday() {
+				onDay = true
+				break
+			}
+		}
+		if !onDay {
+			return false
+		}
+	}
+
+	if r.From != "" {
+		from, _ := minuteOfDay(r.From)
+		to, _ := minuteOfDay(r.To)
+		now := at.Hour()*60 + at.Minute()
+
+		if from <= to {
+			return now >= from && now < to
+		}
+		// The window spans midnight
+		return now >= from || now < to
+	}
+
+	return true
+}
+
+// contains reports whether value is one of values. No values means anything goes.
+func contains(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func minuteOfDay(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,47 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEarnUsesStoreLocalTime(t *testing.T) {
+	d := Definition{
+		EarnRate: 1,
+		BurnRate: DefaultBurnRate,
+		Timezone: "Europe/Dublin",
+		Rules:    []Rule{{Name: "Double points before 10", From: "07:00", To: "10:00", Multiplier: 2}},
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	// 08:30 in Dublin in winter, 03:30 in New York
+	at := time.Date(2024, time.January, 15, 8, 30, 0, 0, time.UTC)
+	lines := []Line{{Amount: 10}}
+
+	tests := []struct {
+		name     string
+		timezone string
+		want     int
+	}{
+		{"store in the rule set's zone", "Europe/Dublin", 20},
+		{"store in another zone", "America/New_York", 10},
+		{"store zone unknown", "", 20},
+		{"store zone invalid", "Nowhere/Special", 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := d.Earn(Purchase{Timezone: tt.timezone, Time: at, Lines: lines})
+			if got != tt.want {
+				t.Errorf("Earn = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// 08:30 on a New York store's own clock
+	local := time.Date(2024, time.January, 15, 13, 30, 0, 0, time.UTC)
+	if got := d.Earn(Purchase{Timezone: "America/New_York", Time: local, Lines: lines}); got != 20 {
+		t.Errorf("Earn at 08:30 New York time = %d, want 20", got)
+	}
+}
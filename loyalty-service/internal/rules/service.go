@@ -0,0 +1,139 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"loyalty-service/internal/model"
+	"loyalty-service/pkg/db"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrVersionConflict is returned when two rule sets are published at the same time.
+var ErrVersionConflict = errors.New("another rule set was published at the same time, try again")
+
+// RuleSet is a published version of the earn and burn rules.
+type RuleSet struct {
+	Version int `json:"version"` // 0 is the built in default, used until a rule set is published
+	Definition
+	CreatedBy    *string   `json:"createdBy,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+// Service publishes rule sets and looks up the one in force.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new rules service.
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// Active returns the newest rule set. Rule sets are shared by every region, so it is read from the
+// default region whichever region ctx names.
+func (s *Service) Active(ctx context.Context) (*RuleSet, error) {
+	var stored model.RuleSet
+	err := s.db.WithContext(db.WithRegion(ctx, db.DefaultRegion)).Order("version DESC").Limit(1).Find(&stored).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.Version == 0 {
+		return &RuleSet{Definition: DefaultDefinition()}, nil
+	}
+
+	return decode(&stored)
+}
+
+// GetRuleSet retrieves a published rule set by its version.
+func (s *Service) GetRuleSet(ctx context.Context, version int) (*RuleSet, error) {
+	if version == 0 {
+		return &RuleSet{Definition: DefaultDefinition()}, nil
+	}
+
+	var stored model.RuleSet
+	if err := s.db.WithContext(ctx).First(&stored, "version = ?", version).Error; err != nil {
+		return nil, err
+	}
+
+	return decode(&stored)
+}
+
+// GetRuleSets lists every published rule set, newest (the one in force) first.
+func (s *Service) GetRuleSets(ctx context.Context) ([]RuleSet, error) {
+	var stored []model.RuleSet
+	if err := s.db.WithContext(ctx).Order("version DESC").Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	ruleSets := make([]RuleSet, 0, len(stored))
+	for i := range stored {
+		ruleSet, err := decode(&stored[i])
+		if err != nil {
+			return nil, err
+		}
+		ruleSets = append(ruleSets, *ruleSet)
+	}
+
+	return ruleSets, nil
+}
+
+// Publish validates a definition and stores it as the next version, which takes effect straight away.
+func (s *Service) Publish(ctx context.Context, definition Definition, createdBy string) (*RuleSet, error) {
+	if definition.Rules == nil {
+		definition.Rules = []Rule{}
+	}
+	if err := definition.Validate(); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(definition)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := model.RuleSet{
+		Definition:   string(encoded),
+		CreatedBy:    &createdBy,
+		CreationDate: time.Now(),
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var latest int
+		err := tx.Model(&model.RuleSet{}).Select("COALESCE(MAX(version), 0)").Scan(&latest).Error
+		if err != nil {
+			return err
+		}
+
+		// The primary key stops two servers publishing the same version
+		stored.Version = latest + 1
+		return tx.Create(&stored).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, ErrVersionConflict
+		}
+		return nil, err
+	}
+
+	return decode(&stored)
+}
+
+func decode(stored *model.RuleSet) (*RuleSet, error) {
+	ruleSet := RuleSet{
+		Version:      stored.Version,
+		CreatedBy:    stored.CreatedBy,
+		CreationDate: stored.CreationDate,
+	}
+
+	if err := json.Unmarshal([]byte(stored.Definition), &ruleSet.Definition); err != nil {
+		return nil, err
+	}
+
+	return &ruleSet, nil
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"loyalty-service/internal/model"
+	"loyalty-service/pkg/db"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidStore is wrapped by every error describing what is wrong with a store's details.
+	ErrInvalidStore = errors.New("invalid store")
+	// ErrStoreNotFound is returned when a store doesn't exist.
+	ErrStoreNotFound = errors.New("store not found")
+	// ErrStoreNotActive is returned when a store that isn't trading is asked to record a purchase.
+	ErrStoreNotActive = errors.New("store is not trading")
+)
+
+var days = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// Service manages the chain's stores.
+type Service struct {
+	db *gorm.DB
+}
+
+// NewService creates a new store service.
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		db: db,
+	}
+}
+
+// CreateStore adds a store to the registry. New stores are active unless a status is given.
+func (s *Service) CreateStore(ctx context.Context, store model.Store) (*model.Store, error) {
+	if store.Status == "" {
+		store.Status = model.StoreActive
+	}
+	if err := validate(&store); err != nil {
+		return nil, err
+	}
+
+	storeID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	store.ID = storeID.String()
+	store.CreationDate = &now
+	for i := range store.OpeningHours {
+		store.OpeningHours[i].StoreID = store.ID
+	}
+
+	if err := s.db.WithContext(ctx).Create(&store).Error; err != nil {
+		return nil, err
+	}
+
+	return &store, nil
+}
+
+// UpdateStore replaces a store's details, opening hours included.
+func (s *Service) UpdateStore(ctx context.Context, storeID string, changes model.Store) (*model.Store, error) {
+	if err := validate(&changes); err != nil {
+		return nil, err
+	}
+
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range changes.OpeningHours {
+		changes.OpeningHours[i].StoreID = store.ID
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(store).Updates(map[string]interface{}{
+			"name":     changes.Name,
+			"region":   changes.Region,
+			"timezone": changes.Timezone,
+			"currency": changes.Currency,
+			"status":   changes.Status,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("store_uuid = ?", store.ID).Delete(&model.OpeningHours{}).Error; err != nil {
+			return err
+		}
+		if len(changes.OpeningHours) == 0 {
+			return nil
+		}
+		return tx.Create(&changes.OpeningHours).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changes.ID = store.ID
+	changes.CreationDate = store.CreationDate
+	return &changes, nil
+}
+
+// CloseStore closes a store for good. It stays in the registry for the purchases made there.
+func (s *Service) CloseStore(ctx context.Context, storeID string) (*model.Store, error) {
+	store, err := s.GetStore(ctx, storeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.WithContext(ctx).Model(store).Update("status", model.StoreClosed).Error; err != nil {
+		return nil, err
+	}
+
+	store.Status = model.StoreClosed
+	return store, nil
+}
+
+// GetStore retrieves a store and its opening hours.
+func (s *Service) GetStore(ctx context.Context, storeID string) (*model.Store, error) {
+	var store model.Store
+	err := s.db.WithContext(ctx).Preload("OpeningHours", orderHours).First(&store, "store_uuid = ?", storeID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStoreNotFound
+		}
+		return nil, err
+	}
+
+	return &store, nil
+}
+
+// GetStores lists the stores in a region, or every store if region is empty, by name.
+func (s *Service) GetStores(ctx context.Context, region string) ([]model.Store, error) {
+	query := s.db.WithContext(ctx).Preload("OpeningHours", orderHours)
+	if region != "" {
+		query = query.Where("region = ?", region)
+	}
+
+	var stores []model.Store
+	if err := query.Order("name").Find(&stores).Error; err != nil {
+		return nil, err
+	}
+
+	return stores, nil
+}
+
+// Trading looks up a store and checks it can record purchases. Stores are shared by every region,
+// so it is read from the default region whichever region ctx names.
+func (s *Service) Trading(ctx context.Context, storeID string) (*model.Store, error) {
+	var store model.Store
+	if err := s.db.WithContext(db.WithRegion(ctx, db.DefaultRegion)).First(&store, "store_uuid = ?", storeID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStoreNotFound
+		}
+		return nil, err
+	}
+
+	if store.Status != model.StoreActive {
+		return nil, ErrStoreNotActive
+	}
+
+	return &store, nil
+}
+
+// orderHours sorts opening hours by their position in the week rather than alphabetically.
+func orderHours(db *gorm.DB) *gorm.DB {
+	return db.Order("FIELD(day, 'mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun')").Order("opens")
+}
+
+// validate checks a store's details, tidying up the currency and days on the way.
+func validate(store *model.Store) error {
+	if strings.TrimSpace(store.Name) == "" {
+		return fmt.Errorf("%w: a name is required", ErrInvalidStore)
+	}
+
+	if store.Timezone == "" {
+		store.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(store.Timezone); err != nil {
+		return fmt.Errorf("%w: unknown timezone %q", ErrInvalidStore, store.Timezone)
+	}
+
+	if store.Currency == "" {
+		store.Currency = "EUR"
+	}
+	store.Currency = strings.ToUpper(store.Currency)
+	if len(store.Currency) != 3 || strings.Trim(store.Currency, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return fmt.Errorf("%w: currency must be a three letter code", ErrInvalidStore)
+	}
+
+	switch store.Status {
+	case model.StoreActive, model.StoreSuspended, model.StoreClosed:
+	default:
+		return fmt.Errorf("%w: status must be %s, %s or %s", ErrInvalidStore, model.StoreActive, model.StoreSuspended, model.StoreClosed)
+	}
+
+	for i := range store.OpeningHours {
+		hours := &store.OpeningHours[i]
+		hours.Day = strings.ToLower(hours.Day)
+		if !isDay(hours.Day) {
+			return fmt.Errorf("%w: unknown day %q", ErrInvalidStore, hours.Day)
+		}
+
+		opens, err := time.Parse("15:04", hours.Opens)
+		if err != nil {
+			return fmt.Errorf("%w: opening time must be HH:MM", ErrInvalidStore)
+		}
+		closes, err := time.Parse("15:04", hours.Closes)
+		if err != nil {
+			return fmt.Errorf("%w: closing time must be HH:MM", ErrInvalidStore)
+		}
+		if opens.Equal(closes) {
+			return fmt.Errorf("%w: a store can't open and close at the same time", ErrInvalidStore)
+		}
+
+		for _, other := range store.OpeningHours[:i] {
+			if other.Day == hours.Day && other.Opens == hours.Opens {
+				return fmt.Errorf("%w: %s has two periods opening at %s", ErrInvalidStore, hours.Day, hours.Opens)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isDay(day string) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package terminal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"loyalty-service/internal/model"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxClockSkew is how far a signed request's timestamp may be from the server's clock.
+// It bounds how long a captured request could be replayed.
+const MaxClockSkew = 5 * time.Minute
+
+var (
+	// ErrStoreNotFound is returned when registering a terminal at a store that doesn't exist.
+	ErrStoreNotFound = errors.New("store not found")
+	// ErrTerminalRevoked is returned when rotating the key of a terminal that has been revoked.
+	ErrTerminalRevoked = errors.New("terminal has been revoked")
+	// ErrInvalidSignature is returned when a request's key, timestamp or signature doesn't check out.
+	ErrInvalidSignature = errors.New("invalid terminal signature")
+)
+
+// Service manages point-of-sale terminals and authenticates their requests.
+//
+// A terminal's secret is never stored. It is derived from the service's master secret and the
+// terminal's key ID, so it can be recomputed to check a signature and rotating the key ID
+// invalidates the old secret.
+type Service struct {
+	db           *gorm.DB
+	masterSecret []byte
+}
+
+// NewService creates a new terminal service that derives terminal secrets from masterSecret.
+func NewService(db *gorm.DB, masterSecret []byte) *Service {
+	return &Service{
+		db:           db,
+		masterSecret: masterSecret,
+	}
+}
+
+// RegisterTerminal adds a terminal to a store and returns it along with its secret.
+// The secret is only ever returned here and by RotateKey.
+func (s *Service) RegisterTerminal(ctx context.Context, storeID, name string) (*model.Terminal, string, error) {
+	var stores int64
+	if err := s.db.WithContext(ctx).Model(&model.Store{}).Where("store_uuid = ?", storeID).Count(&stores).Error; err != nil {
+		return nil, "", err
+	}
+	if stores == 0 {
+		return nil, "", ErrStoreNotFound
+	}
+
+	terminalID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyID, err := generateKeyID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	terminal := model.Terminal{
+		ID:           terminalID.String(),
+		StoreID:      storeID,
+		Name:         name,
+		KeyID:        keyID,
+		CreationDate: time.Now(),
+	}
+
+	if err := s.db.WithContext(ctx).Create(&terminal).Error; err != nil {
+		return nil, "", err
+	}
+
+	return &terminal, s.secretFor(keyID), nil
+}
+
+// GetTerminal retrieves a terminal by its ID.
+func (s *Service) GetTerminal(ctx context.Context, terminalID string) (*model.Terminal, error) {
+	var terminal model.Terminal
+	err := s.db.WithContext(ctx).First(&terminal, "terminal_uuid = ?", terminalID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &terminal, nil
+}
+
+// GetTerminalsByStore lists every terminal registered to a store, including revoked ones.
+func (s *Service) GetTerminalsByStore(ctx context.Context, storeID string) ([]model.Terminal, error) {
+	var terminals []model.Terminal
+	err := s.db.WithContext(ctx).Where("store_uuid = ?", storeID).Order("creation_date").Find(&terminals).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return terminals, nil
+}
+
+// RotateKey gives a terminal a new key and secret. The old key stops working immediately.
+func (s *Service) RotateKey(ctx context.Context, terminalID string) (*model.Terminal, string, error) {
+	terminal, err := s.GetTerminal(ctx, terminalID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if terminal.RevocationDate != nil {
+		return nil, "", ErrTerminalRevoked
+	}
+
+	keyID, err := generateKeyID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	err = s.db.WithContext(ctx).Model(terminal).Updates(map[string]interface{}{
+		"key_id":        keyID,
+		"rotation_date": now,
+	}).Error
+	if err != nil {
+		return nil, "", err
+	}
+
+	terminal.KeyID = keyID
+	terminal.RotationDate = &now
+	return terminal, s.secretFor(keyID), nil
+}
+
+// RevokeTerminal permanently disables a terminal's key.
+func (s *Service) RevokeTerminal(ctx context.Context, terminalID string) (*model.Terminal, error) {
+	terminal, err := s.GetTerminal(ctx, terminalID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Revoking twice keeps the original revocation date
+	if terminal.RevocationDate != nil {
+		return terminal, nil
+	}
+
+	now := time.Now()
+	if err := s.db.WithContext(ctx).Model(terminal).Update("revocation_date", now).Error; err != nil {
+		return nil, err
+	}
+
+	terminal.RevocationDate = &now
+	return terminal, nil
+}
+
+// Authenticate checks a signed request and returns the terminal that sent it.
+//
+// The signature is the hex encoded HMAC-SHA256, keyed with the terminal's secret, of
+// "<timestamp>\n<method>\n<path>\n<body>", where timestamp is the Unix time in seconds
+// and path includes the query string.
+func (s *Service) Authenticate(ctx context.Context, keyID, timestamp, signature, method, path string, body []byte) (*model.Terminal, error) {
+	sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	skew := time.Since(time.Unix(sentAt, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, ErrInvalidSignature
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.secretFor(keyID)))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n"))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return nil, ErrInvalidSignature
+	}
+
+	// Only look the key up once the signature is known to be good
+	var terminal model.Terminal
+	err = s.db.WithContext(ctx).First(&terminal, "key_id = ?", keyID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidSignature
+		}
+		return nil, err
+	}
+
+	if terminal.RevocationDate != nil {
+		return nil, ErrTerminalRevoked
+	}
+
+	return &terminal, nil
+}
+
+// secretFor derives the signing secret that belongs to a key ID.
+func (s *Service) secretFor(keyID string) string {
+	mac := hmac.New(sha256.New, s.masterSecret)
+	mac.Write([]byte("pos-terminal:" + keyID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateKeyID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
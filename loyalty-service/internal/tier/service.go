@@ -0,0 +1,239 @@
+package tier
+
+import (
+	"context"
+	"log"
+	"loyalty-service/internal/model"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// QualificationMonths is the rolling period whose spend decides an account's tier.
+	QualificationMonths = 12
+	// DefaultGraceMonths is how long an account keeps a tier it no longer qualifies for unless configured otherwise.
+	DefaultGraceMonths = 3
+	// DefaultReviewInterval is how often every account's tier is worked out again unless configured otherwise.
+	DefaultReviewInterval = 24 * time.Hour
+)
+
+// Tier is a level of membership reached by spending at least MinSpend within the qualification period.
+type Tier struct {
+	Name       string  `json:"name"`
+	MinSpend   float64 `json:"minSpend"`
+	Multiplier float64 `json:"multiplier"` // applied to the points earned by every purchase
+}
+
+// Tiers lists the membership tiers from lowest to highest.
+var Tiers = []Tier{
+	{Name: model.TierBronze, MinSpend: 0, Multiplier: 1},
+	{Name: model.TierSilver, MinSpend: 250, Multiplier: 1.25},
+	{Name: model.TierGold, MinSpend: 750, Multiplier: 1.5},
+}
+
+// Progress describes an account's tier and how far it is from the next one.
+type Progress struct {
+	Tier            string     `json:"tier"`
+	Multiplier      float64    `json:"multiplier"`
+	Spend           float64    `json:"spend"` // spent by every member within the qualification period
+	QualifiesFor    string     `json:"qualifiesFor"`
+	GraceUntil      *time.Time `json:"graceUntil,omitempty"` // when the account drops to QualifiesFor unless it spends more
+	NextTier        string     `json:"nextTier,omitempty"`
+	SpendToNextTier float64    `json:"spendToNextTier,omitempty"`
+	PeriodStart     time.Time  `json:"periodStart"`
+	LastReviewed    *time.Time `json:"lastReviewed,omitempty"`
+}
+
+// Service works out membership tiers from what an account's members spend.
+//
+// Accounts move up as soon as a review finds they qualify. Moving down waits for a grace period,
+// so an account that stops qualifying keeps its tier for graceMonths to win it back.
+type Service struct {
+	db          *gorm.DB
+	graceMonths int
+}
+
+// NewService creates a new tier service with the given downgrade grace period.
+func NewService(db *gorm.DB, graceMonths int) *Service {
+	return &Service{
+		db:          db,
+		graceMonths: graceMonths,
+	}
+}
+
+// Lookup finds a tier by name, falling back to the lowest tier for unknown names.
+func Lookup(name string) Tier {
+	for _, tier := range Tiers {
+		if tier.Name == name {
+			return tier
+		}
+	}
+	return Tiers[0]
+}
+
+// GetProgress returns an account's tier and its progress towards the next one.
+func (s *Service) GetProgress(ctx context.Context, accountID string) (*Progress, error) {
+	var account model.Account
+	if err := s.db.WithContext(ctx).First(&account, "account_uuid = ?", accountID).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	spend, err := s.spend(s.db.WithContext(ctx), accountID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	current := Lookup(account.Tier)
+	progress := Progress{
+		Tier:         current.Name,
+		Multiplier:   current.Multiplier,
+		Spend:        spend,
+		QualifiesFor: qualifyingTier(spend).Name,
+		GraceUntil:   account.TierGraceUntil,
+		PeriodStart:  periodStart(now),
+		LastReviewed: account.TierReviewDate,
+	}
+
+	for _, tier := range Tiers {
+		if tier.MinSpend > spend && tier.MinSpend > current.MinSpend {
+			progress.NextTier = tier.Name
+			progress.SpendToNextTier = roundCents(tier.MinSpend - spend)
+			break
+		}
+	}
+
+	return &progress, nil
+}
+
+// Review works out an account's tier again and returns it.
+func (s *Service) Review(ctx context.Context, accountID string) (*model.Account, error) {
+	var account model.Account
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_uuid = ?", accountID).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		spend, err := s.spend(tx, accountID, now)
+		if err != nil {
+			return err
+		}
+
+		current := Lookup(account.Tier)
+		target := qualifyingTier(spend)
+
+		switch {
+		case target.MinSpend >= current.MinSpend:
+			// Qualifying for the same tier or a higher one takes effect straight away and ends any grace period
+			account.Tier = target.Name
+			account.TierGraceUntil = nil
+		case account.TierGraceUntil == nil:
+			graceUntil := now.AddDate(0, s.graceMonths, 0)
+			account.TierGraceUntil = &graceUntil
+		case !now.Before(*account.TierGraceUntil):
+			account.Tier = target.Name
+			account.TierGraceUntil = nil
+		}
+		account.TierReviewDate = &now
+
+		return tx.Model(&account).Updates(map[string]interface{}{
+			"tier":             account.Tier,
+			"tier_grace_until": account.TierGraceUntil,
+			"tier_review_date": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// ReviewAll works out the tier of every open account again.
+func (s *Service) ReviewAll(ctx context.Context) error {
+	var accountIDs []string
+	err := s.db.WithContext(ctx).Model(&model.Account{}).Where("closed_date IS NULL").Pluck("account_uuid", &accountIDs).Error
+	if err != nil {
+		return err
+	}
+
+	for _, accountID := range accountIDs {
+		before, err := s.tierOf(ctx, accountID)
+		if err != nil {
+			return err
+		}
+
+		account, err := s.Review(ctx, accountID)
+		if err != nil {
+			return err
+		}
+
+		if account.Tier != before {
+			log.Printf("Account %s moved from %s to %s", accountID, before, account.Tier)
+		}
+	}
+
+	return nil
+}
+
+// Run reviews every account's tier every interval until the context is cancelled.
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ReviewAll(ctx); err != nil {
+				log.Printf("Error reviewing tiers: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Service) tierOf(ctx context.Context, accountID string) (string, error) {
+	var account model.Account
+	if err := s.db.WithContext(ctx).Select("tier").First(&account, "account_uuid = ?", accountID).Error; err != nil {
+		return "", err
+	}
+	return Lookup(account.Tier).Name, nil
+}
+
+// spend adds up what every member of an account spent within the qualification period, less refunds.
+func (s *Service) spend(tx *gorm.DB, accountID string, now time.Time) (float64, error) {
+	var spend float64
+	err := tx.Model(&model.Transaction{}).Select("COALESCE(SUM(amount), 0)").
+		Where("account_uuid = ? AND date >= ?", accountID, periodStart(now)).Scan(&spend).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return roundCents(spend), nil
+}
+
+// qualifyingTier is the highest tier the spend reaches.
+func qualifyingTier(spend float64) Tier {
+	qualified := Tiers[0]
+	for _, tier := range Tiers {
+		if spend >= tier.MinSpend {
+			qualified = tier
+		}
+	}
+	return qualified
+}
+
+func periodStart(now time.Time) time.Time {
+	return now.AddDate(0, -QualificationMonths, 0)
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -2,58 +2,267 @@ package transaction
 
 import (
 	"context"
-	"loyalty-service/internal/account"
+	"encoding/base64"
+	"errors"
+	"loyalty-service/internal/campaign"
+	"loyalty-service/internal/ledger"
 	"loyalty-service/internal/model"
+	"loyalty-service/internal/rules"
+	"loyalty-service/internal/store"
+	"loyalty-service/internal/tier"
 	"math"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+const (
+	// DefaultPageSize is the number of transactions returned per page when no limit is given.
+	DefaultPageSize = 20
+	// MaxPageSize is the largest page of transactions that can be requested.
+	MaxPageSize = 100
+
+	// KindEarn filters the history down to transactions that earned points.
+	KindEarn = "earn"
+	// KindBurn filters the history down to transactions that spent points.
+	KindBurn = "burn"
+
+	// MaxItems is the most lines an itemised purchase can have.
+	MaxItems = 200
+
+	// DefaultVoidWindow is how long after a purchase it can be voided unless configured otherwise.
+	DefaultVoidWindow = 15 * time.Minute
+)
+
+// What happens when refunding a purchase would take back points that have already been spent.
+const (
+	// NegativeBalanceReject refuses the refund.
+	NegativeBalanceReject = "reject"
+	// NegativeBalanceClamp takes back what is left on the account and forgives the rest.
+	NegativeBalanceClamp = "clamp"
+	// NegativeBalanceAllow takes back every point, leaving the account with a negative balance
+	// that future purchases pay off.
+	NegativeBalanceAllow = "allow"
+)
+
+var (
+	// ErrUserNotInAccount is returned when a transaction names a user who isn't a member of the account.
+	ErrUserNotInAccount = errors.New("user is not a member of the account")
+	// ErrStoreRequired is returned when a purchase doesn't say which store it was made at.
+	ErrStoreRequired = errors.New("a purchase must be recorded at a store")
+	// ErrInvalidCursor is returned when a pagination cursor can't be decoded.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidFilter is returned when the history is filtered by an unknown kind of transaction.
+	ErrInvalidFilter = errors.New("type must be earn or burn")
+	// ErrInvalidAmount is returned when a purchase isn't for a positive amount.
+	ErrInvalidAmount = errors.New("amount must be positive")
+	// ErrInvalidItems is returned when an item of a basket has no name or SKU, no quantity or a negative price.
+	ErrInvalidItems = errors.New("every item needs a name or SKU, a positive quantity and a price")
+	// ErrItemsMismatch is returned when a basket's items don't add up to the transaction's amount.
+	ErrItemsMismatch = errors.New("items don't add up to the amount")
+	// ErrInvalidSpend is returned when asked to spend a negative number of points, or both an
+	// exact and a maximum number of points.
+	ErrInvalidSpend = errors.New("give either the points to spend or the most points to spend, not both")
+	// ErrNotRefundable is returned when refunding or voiding something other than a purchase.
+	ErrNotRefundable = errors.New("only purchases can be refunded or voided")
+	// ErrWrongStore is returned when a purchase is refunded or voided at a different store.
+	ErrWrongStore = errors.New("transaction was recorded at another store")
+	// ErrAlreadyReversed is returned when there is nothing left of a purchase to refund, or when
+	// voiding a purchase that has already been partly refunded.
+	ErrAlreadyReversed = errors.New("transaction has already been refunded or voided")
+	// ErrRefundTooLarge is returned when a refund is for more than what is left of the purchase.
+	ErrRefundTooLarge = errors.New("refund is larger than the amount left to refund")
+	// ErrVoidWindowPassed is returned when voiding a purchase after the void window has passed.
+	ErrVoidWindowPassed = errors.New("transaction can no longer be voided, refund it instead")
+)
+
+// HistoryFilter narrows down a transaction history query. Zero values don't filter.
+type HistoryFilter struct {
+	From    *time.Time // inclusive
+	To      *time.Time // exclusive
+	StoreID string
+	Kind    string // KindEarn or KindBurn
+	Cursor  string // NextCursor from the previous page
+	Limit   int
+}
+
+// HistoryPage is one page of a transaction history.
+type HistoryPage struct {
+	Transactions []model.Transaction `json:"transactions"`
+	NextCursor   string              `json:"nextCursor,omitempty"` // empty on the last page
+}
+
+// Spend says how many of the account's points to spend on a purchase. With neither field set,
+// as many points as the purchase needs or the account has are spent.
+type Spend struct {
+	Points    int // spend exactly this many points, failing if the account doesn't have them
+	MaxPoints int // spend as many points as possible, up to this many
+}
+
+// Receipt tells the till what a purchase came to.
+type Receipt struct {
+	Transaction  model.Transaction `json:"transaction"`
+	PointsBurned int               `json:"pointsBurned"`
+	Discount     float64           `json:"discount"`  // money taken off by the points
+	AmountDue    float64           `json:"amountDue"` // what is left to pay
+}
+
+// Reversal is the outcome of refunding or voiding a purchase.
+type Reversal struct {
+	Transaction     model.Transaction `json:"transaction"`
+	PointsForgiven  int               `json:"pointsForgiven"`  // points that couldn't be taken back because they had been spent
+	RemainingAmount float64           `json:"remainingAmount"` // what is left of the purchase to refund
+}
+
 // Service provides methods to interact with transaction data.
 type Service struct {
-	db         *gorm.DB
-	accountSvc *account.Service
+	db             *gorm.DB
+	ledgerSvc      *ledger.Service
+	rulesSvc       *rules.Service
+	campaignSvc    *campaign.Service
+	storeSvc       *store.Service
+	voidWindow     time.Duration
+	negativePolicy string
 }
 
-// NewService creates a new transaction service.
-func NewService(db *gorm.DB, accountSvc *account.Service) *Service {
+// NewService creates a new transaction service that lets purchases be voided for voidWindow
+// and handles refunds of spent points according to negativePolicy.
+func NewService(db *gorm.DB, ledgerSvc *ledger.Service, rulesSvc *rules.Service, campaignSvc *campaign.Service, storeSvc *store.Service, voidWindow time.Duration, negativePolicy string) *Service {
 	return &Service{
-		db:         db,
-		accountSvc: accountSvc,
+		db:             db,
+		ledgerSvc:      ledgerSvc,
+		rulesSvc:       rulesSvc,
+		campaignSvc:    campaignSvc,
+		storeSvc:       storeSvc,
+		voidWindow:     voidWindow,
+		negativePolicy: negativePolicy,
 	}
 }
 
-func (s *Service) ProcessTransaction(ctx context.Context, transaction model.Transaction, usePoints bool) error {
-	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+// ProcessTransaction records a purchase and either credits the points it earns or, if spend is
+// given, spends the account's points on it. Points are worked out with the rule set in force,
+// whose version is recorded on the transaction, plus whatever running campaigns add to them.
+// Purchases paid for with points don't earn campaign points.
+//
+// Spent points never take more off than the purchase costs, so a purchase is only ever partly
+// paid with points if the account runs out or the till asks for fewer. The receipt says how much
+// is left to pay.
+//
+// The account row is locked for the duration of the database transaction, so concurrent
+// purchases on a shared account are applied one after the other and none of them is lost.
+func (s *Service) ProcessTransaction(ctx context.Context, transaction model.Transaction, spend *Spend) (*Receipt, error) {
+	if err := checkItems(&transaction); err != nil {
+		return nil, err
+	}
+	if transaction.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	if transaction.StoreID == nil || *transaction.StoreID == "" {
+		return nil, ErrStoreRequired
+	}
+	if spend != nil && (spend.Points < 0 || spend.MaxPoints < 0 || (spend.Points > 0 && spend.MaxPoints > 0)) {
+		return nil, ErrInvalidSpend
+	}
+
+	receipt := Receipt{AmountDue: transaction.Amount}
+	now := time.Now()
+
+	// Stores, rule sets and campaigns are shared by every region and live in the default one, so
+	// they are read before the transaction on the account's region is opened. Trading fails with
+	// store.ErrStoreNotFound or store.ErrStoreNotActive unless the store is trading.
+	purchaseStore, err := s.storeSvc.Trading(ctx, *transaction.StoreID)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleSet, err := s.rulesSvc.Active(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var running []model.Campaign
+	if spend == nil {
+		running, err = s.campaignSvc.Running(ctx, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		transactionID, err := uuid.NewRandom()
 		if err != nil {
 			return err
 		}
 
 		transaction.ID = transactionID.String()
+		transaction.Type = model.TransactionPurchase
+		transaction.Date = now // never the till's, the void window and history depend on it
+		transaction.OriginalTransactionID = nil
+		transaction.Discount = 0
+		transaction.Campaigns = nil
 
+		for i := range transaction.Items {
+			itemID, err := uuid.NewRandom()
+			if err != nil {
+				return err
+			}
+			transaction.Items[i].ID = itemID.String()
+			transaction.Items[i].ItemNumber = i + 1
+		}
+
+		// The balance read here decides how many points can be spent, so nobody else may
+		// change it until this transaction commits
 		var account model.Account
-		err = s.db.First(&account, "account_uuid = ?", transaction.AccountID).Error
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_uuid = ?", transaction.AccountID).Error
+		if err != nil {
+			return err
+		}
+
+		// Only members of the account can earn or spend its points
+		var members int64
+		err = tx.Model(&model.User{}).Where("user_uuid = ? AND account_uuid = ?", transaction.UserID, transaction.AccountID).Count(&members).Error
 		if err != nil {
 			return err
 		}
+		if members == 0 {
+			return ErrUserNotInAccount
+		}
+
+		transaction.RuleSetVersion = &ruleSet.Version
 
 		var pointsChange int
 
-		if usePoints {
-			pointsRequired := int(math.Ceil(transaction.Amount)) * 10
+		if spend != nil {
+			burned, err := pointsToBurn(spend, ruleSet.Cost(transaction.Amount), account.Points)
+			if err != nil {
+				return err
+			}
 
-			if pointsRequired <= account.Points {
-				pointsChange = -pointsRequired
-			} else {
-				pointsChange = -account.Points
+			pointsChange = -burned
+			receipt.PointsBurned = burned
+			receipt.Discount = transaction.Amount
+			if burned < ruleSet.Cost(transaction.Amount) {
+				receipt.Discount = ruleSet.Discount(burned)
 			}
+			receipt.AmountDue = roundCents(transaction.Amount - receipt.Discount)
+			transaction.Discount = receipt.Discount
 		} else {
-			pointsChange = int(math.Floor(transaction.Amount))
+			purchase := s.purchase(&account, purchaseStore, &transaction, now)
+			pointsChange = ruleSet.Earn(purchase)
+
+			// Creating the transaction records these along with it
+			transaction.Campaigns, err = s.campaignSvc.Apply(tx, transaction.AccountID, running, purchase, ruleSet.LinePoints(purchase))
+			if err != nil {
+				return err
+			}
+			for _, contribution := range transaction.Campaigns {
+				pointsChange += contribution.Points
+			}
 		}
 
-		account.Points += pointsChange
 		transaction.PointsEarned = pointsChange
 
 		err = tx.Create(&transaction).Error
@@ -61,23 +270,352 @@ func (s *Service) ProcessTransaction(ctx context.Context, transaction model.Tran
 			return err
 		}
 
-		err = tx.Save(&account).Error
+		if pointsChange == 0 {
+			return s.ledgerSvc.Touch(tx, transaction.AccountID)
+		}
+
+		entryType := model.LedgerEarn
+		if pointsChange < 0 {
+			entryType = model.LedgerBurn
+		}
+
+		return s.ledgerSvc.Post(tx, entryType, transaction.AccountID, pointsChange, &transaction.ID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	receipt.Transaction = transaction
+	return &receipt, nil
+}
+
+// pointsToBurn works out how many points to spend on a purchase that would cost `cost` points
+// in full from an account with `balance` points.
+func pointsToBurn(spend *Spend, cost, balance int) (int, error) {
+	// A refund may have left the account owing points, there is nothing to spend then
+	available := balance
+	if available < 0 {
+		available = 0
+	}
+
+	burned := cost
+	switch {
+	case spend.Points > 0:
+		// Asking for more points than the purchase needs only spends what it needs
+		if spend.Points < burned {
+			burned = spend.Points
+		}
+		if burned > available {
+			return 0, ledger.ErrInsufficientPoints
+		}
+	case spend.MaxPoints > 0:
+		if spend.MaxPoints < burned {
+			burned = spend.MaxPoints
+		}
+	}
+
+	if burned > available {
+		burned = available
+	}
+
+	return burned, nil
+}
+
+// checkItems validates an itemised basket and works out each line's amount. A transaction sent
+// without an amount is given the total of its items, otherwise the two have to agree to the cent.
+func checkItems(transaction *model.Transaction) error {
+	if len(transaction.Items) == 0 {
+		return nil
+	}
+	if len(transaction.Items) > MaxItems {
+		return ErrInvalidItems
+	}
+
+	total := 0.0
+	for i := range transaction.Items {
+		item := &transaction.Items[i]
+		if (item.Name == "" && item.SKU == "") || item.Quantity <= 0 || item.UnitPrice < 0 {
+			return ErrInvalidItems
+		}
+
+		item.Amount = roundCents(float64(item.Quantity) * item.UnitPrice)
+		total += item.Amount
+	}
+	total = roundCents(total)
+
+	if transaction.Amount == 0 {
+		transaction.Amount = total
+	} else if roundCents(transaction.Amount) != total {
+		return ErrItemsMismatch
+	}
+
+	return nil
+}
+
+// purchase describes a transaction to the rules engine. Each item of a basket is a line of its own,
+// so rules can depend on its category. The account's tier multiplies whatever the rules earn.
+func (s *Service) purchase(account *model.Account, purchaseStore *model.Store, transaction *model.Transaction, at time.Time) rules.Purchase {
+	accountTier := tier.Lookup(account.Tier)
+	purchase := rules.Purchase{
+		StoreID:        purchaseStore.ID,
+		Region:         purchaseStore.Region,
+		Tier:           accountTier.Name,
+		TierMultiplier: accountTier.Multiplier,
+		Timezone:       purchaseStore.Timezone,
+		Time:           at,
+		Lines:          []rules.Line{{Amount: transaction.Amount}},
+	}
+
+	if len(transaction.Items) > 0 {
+		purchase.Lines = make([]rules.Line, len(transaction.Items))
+		for i, item := range transaction.Items {
+			purchase.Lines[i] = rules.Line{Amount: item.Amount, SKU: item.SKU, Category: item.Category}
+		}
+	}
+
+	return purchase
+}
+
+// RefundTransaction gives back some or all of a purchase at the store it was made at, reversing
+// the points it earned or restoring the points spent on it in proportion. A nil amount refunds
+// whatever is left of the purchase.
+func (s *Service) RefundTransaction(ctx context.Context, originalID string, amount *float64, storeID string) (*Reversal, error) {
+	return s.reverse(ctx, originalID, amount, storeID, model.TransactionRefund)
+}
+
+// VoidTransaction cancels a purchase in full. Only purchases made within the void window that
+// haven't been refunded can be voided.
+func (s *Service) VoidTransaction(ctx context.Context, originalID, storeID string) (*Reversal, error) {
+	return s.reverse(ctx, originalID, nil, storeID, model.TransactionVoid)
+}
+
+// reverse records a refund or void of a purchase and gives back its points.
+func (s *Service) reverse(ctx context.Context, originalID string, amount *float64, storeID, kind string) (*Reversal, error) {
+	var reversal Reversal
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the purchase so two refunds can't both take what is left of it
+		var original model.Transaction
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&original, "transaction_uuid = ?", originalID).Error
 		if err != nil {
 			return err
 		}
 
-		return nil
+		if original.Type != model.TransactionPurchase || original.Amount <= 0 {
+			return ErrNotRefundable
+		}
+		if original.StoreID == nil || *original.StoreID != storeID {
+			return ErrWrongStore
+		}
+
+		var previous struct {
+			Amount float64
+			Count  int64
+		}
+		err = tx.Model(&model.Transaction{}).Select("COALESCE(SUM(-amount), 0) AS amount, COUNT(*) AS count").
+			Where("original_transaction_uuid = ?", originalID).Scan(&previous).Error
+		if err != nil {
+			return err
+		}
+
+		remaining := roundCents(original.Amount - previous.Amount)
+		if remaining <= 0 {
+			return ErrAlreadyReversed
+		}
+
+		if kind == model.TransactionVoid {
+			if previous.Count > 0 {
+				return ErrAlreadyReversed
+			}
+			if time.Since(original.Date) > s.voidWindow {
+				return ErrVoidWindowPassed
+			}
+		}
+
+		refund := remaining
+		if amount != nil {
+			refund = roundCents(*amount)
+			if refund > remaining {
+				return ErrRefundTooLarge
+			}
+		}
+
+		// Points are given back in proportion to the money. Working from the running totals means
+		// a purchase refunded in parts gives back exactly what it earned once fully refunded.
+		refunded := roundCents(previous.Amount + refund)
+		pointsChange := pointsReversed(original, previous.Amount) - pointsReversed(original, refunded)
+
+		var account model.Account
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&account, "account_uuid = ?", original.AccountID).Error
+		if err != nil {
+			return err
+		}
+
+		allowNegative := false
+		switch {
+		case account.ClosedDate != nil:
+			// The account's points were forfeited when it closed, there is nothing to give back
+			pointsChange = 0
+		case pointsChange < 0 && account.Points+pointsChange < 0:
+			switch s.negativePolicy {
+			case NegativeBalanceAllow:
+				allowNegative = true
+			case NegativeBalanceClamp:
+				available := account.Points
+				if available < 0 {
+					available = 0
+				}
+				reversal.PointsForgiven = -pointsChange - available
+				pointsChange = -available
+			default:
+				return ledger.ErrInsufficientPoints
+			}
+		}
+
+		transactionID, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+
+		reversal.Transaction = model.Transaction{
+			ID:                    transactionID.String(),
+			AccountID:             original.AccountID,
+			UserID:                original.UserID,
+			StoreID:               &storeID,
+			Type:                  kind,
+			OriginalTransactionID: &original.ID,
+			Amount:                -refund,
+			PointsEarned:          pointsChange,
+			RuleSetVersion:        original.RuleSetVersion, // given back in proportion, not worked out again
+		}
+		reversal.RemainingAmount = roundCents(original.Amount - refunded)
+
+		if err := tx.Create(&reversal.Transaction).Error; err != nil {
+			return err
+		}
+
+		if pointsChange == 0 {
+			return s.ledgerSvc.Touch(tx, original.AccountID)
+		}
+
+		// Earned points go back to where they were issued from, spent points come back from redemption
+		counterpart := ledger.SystemIssued
+		if original.PointsEarned < 0 {
+			counterpart = ledger.SystemRedeemed
+		}
+
+		return s.ledgerSvc.Record(tx, model.LedgerRefund, &reversal.Transaction.ID, kind+" of "+original.ID,
+			ledger.Leg{AccountRef: original.AccountID, Points: pointsChange, AllowNegative: allowNegative},
+			ledger.Leg{AccountRef: counterpart, Points: -pointsChange},
+		)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &reversal, nil
+}
+
+// pointsReversed is how many of a purchase's points have been given back once the given amount
+// of it has been refunded, rounded towards zero.
+func pointsReversed(original model.Transaction, refunded float64) int {
+	if refunded >= original.Amount {
+		return original.PointsEarned
+	}
+
+	return int(math.Trunc(float64(original.PointsEarned) * refunded / original.Amount))
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// GetTransactionsByUserID retrieves a page of the transactions a user made, newest first.
+func (s *Service) GetTransactionsByUserID(ctx context.Context, userID string, filter HistoryFilter) (*HistoryPage, error) {
+	return s.history(ctx, "user_uuid = ?", userID, filter)
+}
+
+// GetTransactionsByAccountID retrieves a page of the transactions made by every member of an account, newest first.
+func (s *Service) GetTransactionsByAccountID(ctx context.Context, accountID string, filter HistoryFilter) (*HistoryPage, error) {
+	return s.history(ctx, "account_uuid = ?", accountID, filter)
+}
+
+func (s *Service) history(ctx context.Context, owner string, ownerID string, filter HistoryFilter) (*HistoryPage, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultPageSize
+	} else if filter.Limit > MaxPageSize {
+		filter.Limit = MaxPageSize
+	}
+
+	query := s.db.WithContext(ctx).Where(owner, ownerID)
+
+	if filter.From != nil {
+		query = query.Where("date >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("date < ?", *filter.To)
+	}
+	if filter.StoreID != "" {
+		query = query.Where("store_uuid = ?", filter.StoreID)
+	}
+
+	switch filter.Kind {
+	case "":
+	case KindEarn:
+		query = query.Where("points_earned > 0")
+	case KindBurn:
+		query = query.Where("points_earned < 0")
+	default:
+		return nil, ErrInvalidFilter
+	}
+
+	// Keyset pagination: continue strictly after the last row of the previous page
+	if filter.Cursor != "" {
+		date, id, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("date < ? OR (date = ? AND transaction_uuid < ?)", date, date, id)
+	}
+
+	// Fetch one extra row to find out whether there is another page
+	var transactions []model.Transaction
+	err := query.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("item_number")
+	}).Preload("Campaigns").Order("date DESC").Order("transaction_uuid DESC").Limit(filter.Limit + 1).Find(&transactions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := HistoryPage{Transactions: transactions}
+	if len(transactions) > filter.Limit {
+		page.Transactions = transactions[:filter.Limit]
+		last := page.Transactions[filter.Limit-1]
+		page.NextCursor = encodeCursor(last.Date, last.ID)
+	}
+
+	return &page, nil
+}
+
+func encodeCursor(date time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(date.UTC().Format(time.RFC3339Nano) + "," + id))
 }
 
-// // GetTransactionsByUserID retrieves transactions for a specific user from the database
-// func (s *Service) GetTransactionsByUserID(ctx context.Context, userID string) ([]model.Transaction, error) {
-// 	var transactions []model.Transaction
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
 
-// 	err := s.db.WithContext(ctx).Where("account_uuid = ?", userID).Find(&transactions).Error
-// 	if err != nil {
-// 		return nil, err
-// 	}
+	date, id, found := strings.Cut(string(raw), ",")
+	if !found || id == "" {
+		return time.Time{}, "", ErrInvalidCursor
+	}
 
-// 	return transactions, nil
-// }
+	t, err := time.Parse(time.RFC3339Nano, date)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+
+	return t, id, nil
+}
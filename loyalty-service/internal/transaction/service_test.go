@@ -0,0 +1,239 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+	"loyalty-service/internal/account"
+	"loyalty-service/internal/campaign"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/model"
+	"loyalty-service/internal/rules"
+	"loyalty-service/internal/store"
+	"loyalty-service/internal/testdb"
+	"loyalty-service/pkg/db"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TestConcurrentPurchasesAndSpends hammers one shared account with purchases from both of its
+// members and manual debits at the same time, and checks that no change to its balance is lost.
+func TestConcurrentPurchasesAndSpends(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+
+	ledgerSvc := ledger.NewService(db)
+	accountSvc := account.NewService(db, ledgerSvc, account.DefaultMemberLimit, account.ExitPointsStay)
+	s := NewService(db, ledgerSvc, rules.NewService(db), campaign.NewService(db), store.NewService(db),
+		DefaultVoidWindow, NegativeBalanceClamp)
+
+	storeID := "store"
+	seed := []interface{}{
+		&model.Store{ID: storeID, Name: "Store", Region: "Europe", Timezone: "UTC", Currency: "EUR", Status: model.StoreActive},
+		&model.Account{ID: "acc", Tier: model.TierBronze},
+		&model.User{ID: "alice", AccountID: strPtr("acc"), Name: "Alice", Email: "alice@example.com", Phone: "1"},
+		&model.User{ID: "bob", AccountID: strPtr("acc"), Name: "Bob", Email: "bob@example.com", Phone: "2"},
+	}
+	for _, row := range seed {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+	}
+
+	const (
+		opening   = 1000
+		purchases = 40
+		spends    = 40
+		spent     = 5
+	)
+	if _, err := accountSvc.AddPoints(ctx, "acc", opening); err != nil {
+		t.Fatalf("seeding points: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	earned := make([]int, purchases)
+	errs := make(chan error, purchases+spends)
+
+	for i := 0; i < purchases; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			user := "alice"
+			if i%2 == 1 {
+				user = "bob"
+			}
+			receipt, err := s.ProcessTransaction(ctx, model.Transaction{
+				AccountID: "acc",
+				UserID:    user,
+				StoreID:   &storeID,
+				Amount:    3.70 + float64(i),
+			}, nil)
+			if err != nil {
+				errs <- fmt.Errorf("purchase %d: %w", i, err)
+				return
+			}
+			earned[i] = receipt.Transaction.PointsEarned
+		}(i)
+	}
+
+	for i := 0; i < spends; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			if _, err := accountSvc.SubtractPoints(ctx, "acc", spent); err != nil {
+				errs <- fmt.Errorf("spend %d: %w", i, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	want := opening - spends*spent
+	for _, points := range earned {
+		want += points
+	}
+
+	balance, err := ledgerSvc.Balance(ctx, "acc")
+	if err != nil {
+		t.Fatalf("ledger balance: %v", err)
+	}
+	if balance != want {
+		t.Errorf("ledger balance = %d, want %d", balance, want)
+	}
+
+	acc, err := accountSvc.GetAccount(ctx, "acc")
+	if err != nil {
+		t.Fatalf("loading account: %v", err)
+	}
+	if acc.Points != want {
+		t.Errorf("cached balance = %d, want %d", acc.Points, want)
+	}
+
+	var recorded int64
+	db.Model(&model.Transaction{}).Where("account_uuid = ?", "acc").Count(&recorded)
+	if recorded != purchases {
+		t.Errorf("%d purchases recorded, want %d", recorded, purchases)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// TestPurchaseDateIsTheServers checks that a till can't backdate or postdate a purchase, which
+// would let it be voided forever or never and put it out of place in the history.
+func TestPurchaseDateIsTheServers(t *testing.T) {
+	db := testdb.Open(t)
+	ctx := context.Background()
+
+	ledgerSvc := ledger.NewService(db)
+	s := NewService(db, ledgerSvc, rules.NewService(db), campaign.NewService(db), store.NewService(db),
+		time.Minute, NegativeBalanceClamp)
+
+	storeID := "store"
+	seed := []interface{}{
+		&model.Store{ID: storeID, Name: "Store", Region: "Europe", Timezone: "UTC", Currency: "EUR", Status: model.StoreActive},
+		&model.Account{ID: "acc", Tier: model.TierBronze},
+		&model.User{ID: "alice", AccountID: strPtr("acc"), Name: "Alice", Email: "alice@example.com", Phone: "1"},
+	}
+	for _, row := range seed {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+	}
+
+	for _, sent := range []time.Time{time.Now().AddDate(1, 0, 0), time.Now().AddDate(-1, 0, 0)} {
+		before := time.Now()
+		receipt, err := s.ProcessTransaction(ctx, model.Transaction{
+			AccountID: "acc",
+			UserID:    "alice",
+			StoreID:   &storeID,
+			Amount:    10,
+			Date:      sent,
+		}, nil)
+		if err != nil {
+			t.Fatalf("ProcessTransaction: %v", err)
+		}
+
+		var stored model.Transaction
+		if err := db.First(&stored, "transaction_uuid = ?", receipt.Transaction.ID).Error; err != nil {
+			t.Fatalf("loading purchase: %v", err)
+		}
+		if stored.Date.Before(before.Add(-time.Second)) || stored.Date.After(time.Now().Add(time.Second)) {
+			t.Errorf("purchase sent with date %v stored with date %v, want the time it was recorded", sent, stored.Date)
+		}
+
+		// Within the void window whatever date was sent
+		if _, err := s.VoidTransaction(ctx, receipt.Transaction.ID, storeID); err != nil {
+			t.Errorf("voiding a purchase sent with date %v: %v", sent, err)
+		}
+	}
+}
+
+// TestPurchaseInAnotherRegion records a purchase for an account outside the default region, at a
+// store and with a campaign that are only kept in the default region.
+func TestPurchaseInAnotherRegion(t *testing.T) {
+	routed, regions := testdb.OpenRegions(t, "eu")
+	shared, eu := regions[db.DefaultRegion], regions["eu"]
+	ctx := db.WithRegion(context.Background(), "eu")
+
+	ledgerSvc := ledger.NewService(routed)
+	s := NewService(routed, ledgerSvc, rules.NewService(routed), campaign.NewService(routed), store.NewService(routed),
+		DefaultVoidWindow, NegativeBalanceClamp)
+
+	storeID := "store"
+	seed := []struct {
+		region *gorm.DB
+		row    interface{}
+	}{
+		{shared, &model.Store{ID: storeID, Name: "Store", Region: "Europe", Timezone: "UTC", Currency: "EUR", Status: model.StoreActive}},
+		{shared, &model.Campaign{ID: "bonus", Name: "Bonus", Kind: model.CampaignBonus, BonusPoints: 50, Targeting: "{}",
+			StartDate: time.Now().Add(-time.Hour), CreatedBy: strPtr("admin"), CreationDate: time.Now()}},
+		{eu, &model.Account{ID: "acc", Region: "eu", Tier: model.TierBronze}},
+		{eu, &model.User{ID: "alice", AccountID: strPtr("acc"), Name: "Alice", Email: "alice@example.com", Phone: "1"}},
+	}
+	for _, seeded := range seed {
+		if err := seeded.region.Create(seeded.row).Error; err != nil {
+			t.Fatalf("seeding: %v", err)
+		}
+	}
+
+	receipt, err := s.ProcessTransaction(ctx, model.Transaction{
+		AccountID: "acc",
+		UserID:    "alice",
+		StoreID:   &storeID,
+		Amount:    10,
+	}, nil)
+	if err != nil {
+		t.Fatalf("ProcessTransaction: %v", err)
+	}
+	if len(receipt.Transaction.Campaigns) != 1 || receipt.Transaction.Campaigns[0].Points != 50 {
+		t.Errorf("campaigns = %+v, want 50 points from the bonus campaign", receipt.Transaction.Campaigns)
+	}
+
+	for _, table := range []interface{}{&model.Transaction{}, &model.TransactionCampaign{}, &model.LedgerEntry{}} {
+		var inRegion, inDefault int64
+		eu.Model(table).Count(&inRegion)
+		shared.Model(table).Count(&inDefault)
+		if inRegion == 0 || inDefault != 0 {
+			t.Errorf("%T: %d rows in the account's region and %d in the default region, want them all in the account's",
+				table, inRegion, inDefault)
+		}
+	}
+
+	var acc model.Account
+	if err := eu.First(&acc, "account_uuid = ?", "acc").Error; err != nil {
+		t.Fatalf("loading account: %v", err)
+	}
+	if acc.Points != receipt.Transaction.PointsEarned {
+		t.Errorf("balance = %d, want the %d points earned", acc.Points, receipt.Transaction.PointsEarned)
+	}
+}
@@ -2,13 +2,42 @@ package user
 
 import (
 	"context"
+	"errors"
 	"loyalty-service/internal/model"
+	"loyalty-service/pkg/db"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var (
+	// ErrInvalidCredentials is returned when an email and password pair does not match a user.
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	// ErrInvalidRole is returned when a role is unknown or doesn't fit the given store.
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrStoreNotFound is returned when a role is assigned at a store that doesn't exist.
+	ErrStoreNotFound = errors.New("store not found")
+	// ErrEmailTaken is returned when another user already has the email address.
+	ErrEmailTaken = errors.New("email address is already in use")
+	// ErrPhoneTaken is returned when another user already has the phone number.
+	ErrPhoneTaken = errors.New("phone number is already in use")
+	// ErrIncorrectPassword is returned when a password change doesn't supply the right current password.
+	ErrIncorrectPassword = errors.New("current password is incorrect")
+	// ErrInvalidUpdate is returned when an update would blank a required field.
+	ErrInvalidUpdate = errors.New("name, email and password can't be empty")
+)
+
+// Update lists the fields to change on a user. Nil fields are left as they are.
+type Update struct {
+	Name            *string
+	Email           *string
+	Phone           *string
+	CurrentPassword *string // required to change the password
+	NewPassword     *string
+}
+
 // Service provides methods to interact with user data.
 type Service struct {
 	db *gorm.DB
@@ -21,7 +50,7 @@ func NewService(db *gorm.DB) *Service {
 	}
 }
 
-// CreateUser creates a new user in the database.
+// CreateUser registers a new customer. Role, account and store are ignored, see SetRole.
 func (s *Service) CreateUser(ctx context.Context, u model.User) (*model.User, error) {
 	userID, err := uuid.NewRandom()
 	if err != nil {
@@ -30,6 +59,18 @@ func (s *Service) CreateUser(ctx context.Context, u model.User) (*model.User, er
 
 	u.ID = userID.String()
 
+	// New users always start as customers without an account, whatever the caller asked for.
+	// Roles are only ever given through SetRole
+	u.AccountID = nil
+	u.Account = nil
+	u.Role = model.RoleCustomer
+	u.StoreID = nil
+
+	// Catch duplicates up front for a clear error, the unique index still guards against races
+	if err := s.checkUnique(s.db.WithContext(ctx), u.ID, &u.Email, &u.Phone); err != nil {
+		return nil, err
+	}
+
 	// Hash the user's password before storing it
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -45,15 +86,173 @@ func (s *Service) CreateUser(ctx context.Context, u model.User) (*model.User, er
 	return &u, nil
 }
 
+// UpdateUser applies a partial update to a user. Changing the password requires the current one.
+func (s *Service) UpdateUser(ctx context.Context, userID string, update Update) (*model.User, error) {
+	if isBlank(update.Name) || isBlank(update.Email) || isBlank(update.NewPassword) {
+		return nil, ErrInvalidUpdate
+	}
+
+	var user model.User
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "user_uuid = ?", userID).Error
+		if err != nil {
+			return err
+		}
+
+		changes := map[string]interface{}{}
+
+		if update.Name != nil {
+			changes["name"] = *update.Name
+			user.Name = *update.Name
+		}
+
+		if update.Email != nil && *update.Email != user.Email {
+			if err := s.checkUnique(tx, userID, update.Email, nil); err != nil {
+				return err
+			}
+			changes["email_address"] = *update.Email
+			user.Email = *update.Email
+		}
+
+		if update.Phone != nil && *update.Phone != user.Phone {
+			if err := s.checkUnique(tx, userID, nil, update.Phone); err != nil {
+				return err
+			}
+			changes["phone_number"] = *update.Phone
+			user.Phone = *update.Phone
+		}
+
+		if update.NewPassword != nil {
+			if update.CurrentPassword == nil ||
+				bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(*update.CurrentPassword)) != nil {
+				return ErrIncorrectPassword
+			}
+
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*update.NewPassword), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			changes["password"] = string(hashedPassword)
+			user.Password = string(hashedPassword)
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+
+		return tx.Model(&user).Updates(changes).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// checkUnique makes sure no other user has the given email address or phone number.
+// Empty phone numbers are allowed on any number of users.
+func (s *Service) checkUnique(tx *gorm.DB, userID string, email, phone *string) error {
+	var count int64
+
+	if email != nil {
+		err := tx.Model(&model.User{}).Where("email_address = ? AND user_uuid <> ?", *email, userID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrEmailTaken
+		}
+	}
+
+	if phone != nil && *phone != "" {
+		err := tx.Model(&model.User{}).Where("phone_number = ? AND user_uuid <> ?", *phone, userID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrPhoneTaken
+		}
+	}
+
+	return nil
+}
+
+func isBlank(field *string) bool {
+	return field != nil && *field == ""
+}
+
 // GetUserByID retrieves a user by their ID from the database.
 func (s *Service) GetUserByID(ctx context.Context, userID string) (*model.User, error) {
 	var user model.User
 	return &user, s.db.WithContext(ctx).First(&user, "user_uuid = ?", userID).Error
 }
 
-// // GetUserByEmail retrieves a user by their email from the database.
-// func (s *Service) GetUserByEmail(ctx context.Context, email string) (*model.User, error) {
-// 	var user model.User
-// 	err := s.db.WithContext(ctx).Where("email_address = ?", email).First(&user).Error
-// 	return &user, err
-// }
+// GetUserByEmail retrieves a user by their email from the database.
+func (s *Service) GetUserByEmail(ctx context.Context, email string) (*model.User, error) {
+	var user model.User
+	err := s.db.WithContext(ctx).Where("email_address = ?", email).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Authenticate checks a password against the bcrypt hash stored for the user with the given email.
+func (s *Service) Authenticate(ctx context.Context, email, password string) (*model.User, error) {
+	user, err := s.GetUserByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	// Users created outside the API (e.g. seed data) have no password and can't log in
+	if user.Password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// SetRole changes a user's role. Store staff and managers must be assigned to a store,
+// customers and admins must not be.
+func (s *Service) SetRole(ctx context.Context, userID, role string, storeID *string) (*model.User, error) {
+	if !model.IsValidRole(role) || model.IsStoreRole(role) != (storeID != nil) {
+		return nil, ErrInvalidRole
+	}
+
+	// Stores are shared by every region and live in the default one, wherever the user lives
+	if storeID != nil {
+		var stores int64
+		if err := s.db.WithContext(db.WithRegion(ctx, db.DefaultRegion)).Model(&model.Store{}).Where("store_uuid = ?", *storeID).Count(&stores).Error; err != nil {
+			return nil, err
+		}
+		if stores == 0 {
+			return nil, ErrStoreNotFound
+		}
+	}
+
+	user, err := s.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.WithContext(ctx).Model(user).Updates(map[string]interface{}{
+		"role":       role,
+		"store_uuid": storeID,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	user.Role = role
+	user.StoreID = storeID
+	return user, nil
+}
@@ -1,22 +1,34 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"loyalty-service/internal/account"
 	"loyalty-service/internal/api"
+	"loyalty-service/internal/auth"
+	"loyalty-service/internal/campaign"
+	"loyalty-service/internal/expiry"
+	"loyalty-service/internal/idempotency"
 	"loyalty-service/internal/invitation"
+	"loyalty-service/internal/ledger"
+	"loyalty-service/internal/migration"
+	"loyalty-service/internal/reward"
+	"loyalty-service/internal/rules"
+	"loyalty-service/internal/store"
+	"loyalty-service/internal/terminal"
+	"loyalty-service/internal/tier"
 	"loyalty-service/internal/transaction"
 	"loyalty-service/internal/user"
 	"loyalty-service/pkg/db"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/pelletier/go-toml/v2"
 )
 
-type ConfigRegion []string
-type Config map[string]ConfigRegion
-
 func main() {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -28,29 +40,108 @@ func main() {
 		panic(err)
 	}
 
-	var cfg Config
-	err = toml.Unmarshal(cfgData, &cfg)
+	cfg, err := db.ParseConfig(cfgData)
 	if err != nil {
 		panic(err)
 	}
 
-	// Connect to MySQL
-	database, err := db.Connect(cfg["default"])
+	// "migrate up", "migrate down [steps]" and "migrate status" manage every region's schema instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// Session tokens must be signed with the same secret on every API server
+	tokenSecret := os.Getenv("AUTH_TOKEN_SECRET")
+	if tokenSecret == "" {
+		panic("AUTH_TOKEN_SECRET must be set")
+	}
+
+	// Point-of-sale terminal secrets are derived from this, changing it invalidates every terminal key
+	terminalSecret := os.Getenv("POS_TERMINAL_SECRET")
+	if terminalSecret == "" {
+		panic("POS_TERMINAL_SECRET must be set")
+	}
+
+	// What happens to a member's points when they leave a shared account
+	exitPolicy := os.Getenv("MEMBER_EXIT_POINTS_POLICY")
+	if exitPolicy == "" {
+		exitPolicy = account.ExitPointsStay
+	} else if exitPolicy != account.ExitPointsStay && exitPolicy != account.ExitPointsFollow {
+		panic("MEMBER_EXIT_POINTS_POLICY must be stay or follow")
+	}
+
+	// What happens when a refund takes back points that have already been spent
+	negativePolicy := os.Getenv("NEGATIVE_BALANCE_POLICY")
+	if negativePolicy == "" {
+		negativePolicy = transaction.NegativeBalanceClamp
+	} else if negativePolicy != transaction.NegativeBalanceReject && negativePolicy != transaction.NegativeBalanceClamp &&
+		negativePolicy != transaction.NegativeBalanceAllow {
+		panic("NEGATIVE_BALANCE_POLICY must be reject, clamp or allow")
+	}
+
+	// Connect to the MySQL cluster of every region
+	database, regions, err := db.Connect(cfg, envDuration("READ_YOUR_WRITES_WINDOW", db.DefaultReadYourWritesWindow))
 	if err != nil {
 		panic(err)
 	}
 
+	// Refuse to serve from a schema the service wasn't built for
+	migrationService := migration.NewService(database)
+	for _, region := range regions.Names() {
+		if err := migrationService.Check(db.WithRegion(context.Background(), region)); err != nil {
+			log.Fatalf("Region %q: %v", region, err)
+		}
+	}
+
 	// Initialize services with the database
 	userService := user.NewService(database)
-	accountService := account.NewService(database)
-	transactionService := transaction.NewService(database, accountService)
+	ledgerService := ledger.NewService(database)
+	rulesService := rules.NewService(database)
+	rewardService := reward.NewService(database, ledgerService)
+	campaignService := campaign.NewService(database)
+	storeService := store.NewService(database)
+	expiryService := expiry.NewService(database, ledgerService, envInt("POINTS_EXPIRY_MONTHS", expiry.DefaultLifetimeMonths))
+	tierService := tier.NewService(database, envInt("TIER_GRACE_MONTHS", tier.DefaultGraceMonths))
+	accountService := account.NewService(database, ledgerService, envInt("ACCOUNT_MEMBER_LIMIT", account.DefaultMemberLimit), exitPolicy)
+	transactionService := transaction.NewService(database, ledgerService, rulesService, campaignService, storeService, envDuration("TRANSACTION_VOID_WINDOW", transaction.DefaultVoidWindow), negativePolicy)
 	invitationService := invitation.NewService(database, userService, accountService)
+	authService := auth.NewService([]byte(tokenSecret), userService)
+	terminalService := terminal.NewService(database, []byte(terminalSecret))
+	idempotencyService := idempotency.NewService(database, envDuration("IDEMPOTENCY_KEY_RETENTION", idempotency.DefaultRetention))
+
+	reconcileInterval := envDuration("LEDGER_RECONCILE_INTERVAL", ledger.DefaultReconcileInterval)
+	expiryInterval := envDuration("POINTS_EXPIRY_INTERVAL", expiry.DefaultRunInterval)
+	expiryDryRun := os.Getenv("POINTS_EXPIRY_DRY_RUN") == "true"
+	tierInterval := envDuration("TIER_REVIEW_INTERVAL", tier.DefaultReviewInterval)
+
+	// Take database servers out of the pool while they are down, and back in once they answer again
+	go regions.Run(context.Background(), envDuration("DB_HEALTH_CHECK_INTERVAL", db.DefaultHealthCheckInterval))
+
+	// Background jobs run against every region's cluster separately
+	for _, region := range regions.Names() {
+		ctx := db.WithRegion(context.Background(), region)
+
+		// Forget idempotency keys once their retention window has passed
+		go idempotencyService.Run(ctx, time.Hour)
+
+		// Report accounts whose cached balance no longer matches the points ledger
+		go ledgerService.Run(ctx, reconcileInterval)
+
+		// Expire points that have gone unspent for too long, or only log what would expire in a dry run
+		go expiryService.Run(ctx, expiryInterval, expiryDryRun)
+
+		// Move accounts between tiers as their members' spend over the last year changes
+		go tierService.Run(ctx, tierInterval)
+	}
 
 	// Set up Gin router and routes
 	router := gin.Default()
 
 	// Initialize the handler with the services
-	handler := api.NewHandler(userService, transactionService, accountService, invitationService)
+	handler := api.NewHandler(authService, userService, transactionService, accountService, invitationService, terminalService, idempotencyService, ledgerService, rulesService, rewardService, expiryService, tierService, campaignService, storeService, regions)
 
 	// Setup routes using the handler
 	handler.SetupRoutes(router)
@@ -60,3 +151,95 @@ func main() {
 		log.Fatalf("Failed to run server: %v", err)
 	}
 }
+
+// migrate applies or rolls back the schema migrations of every region, or shows where each region is at.
+func migrate(cfg map[string]db.Cluster, args []string) error {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		return errors.New("usage: migrate up | down [steps] | status")
+	}
+
+	steps := 1
+	if args[0] == "down" && len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid number of steps %q", args[1])
+		}
+		steps = n
+	}
+
+	database, regions, err := db.Connect(cfg, 0)
+	if err != nil {
+		return err
+	}
+	defer regions.Close()
+
+	migrationService := migration.NewService(database)
+	for _, region := range regions.Names() {
+		ctx := db.WithRegion(context.Background(), region)
+
+		switch args[0] {
+		case "up":
+			count, err := migrationService.Up(ctx)
+			if err != nil {
+				return fmt.Errorf("region %q: %w", region, err)
+			}
+			log.Printf("Region %q: applied %d migrations, the schema is at version %d", region, count, migration.Latest())
+		case "down":
+			count, err := migrationService.Down(ctx, steps)
+			if err != nil {
+				return fmt.Errorf("region %q: %w", region, err)
+			}
+			log.Printf("Region %q: rolled back %d migrations", region, count)
+		case "status":
+			statuses, err := migrationService.Status(ctx)
+			if err != nil {
+				return fmt.Errorf("region %q: %w", region, err)
+			}
+			fmt.Printf("Region %s\n", region)
+			for _, status := range statuses {
+				state := "pending"
+				switch {
+				case status.Dirty:
+					state = "dirty"
+				case status.Modified:
+					state = "changed since applied"
+				case status.Applied:
+					state = "applied " + status.AppliedDate.Format(time.RFC3339)
+				}
+				fmt.Printf("  %04d %-30s %s\n", status.Version, status.Name, state)
+			}
+		}
+	}
+
+	return nil
+}
+
+// envInt reads an integer setting from the environment, falling back to def when it isn't set.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %v", name, err)
+	}
+
+	return n
+}
+
+// envDuration reads a duration setting such as "24h" from the environment, falling back to def when it isn't set.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid value for %s: %q", name, value)
+	}
+
+	return d
+}
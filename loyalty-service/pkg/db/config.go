@@ -0,0 +1,81 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Cluster lists the MySQL servers of a region. Writes, transactions and most reads go to the
+// primaries, reads that may be a little stale can go to the replicas.
+type Cluster struct {
+	Primaries []string
+	Replicas  []string
+}
+
+// ParseConfig reads the regions of loyalty-service.toml. A region is either a list of servers,
+// which are all primaries, or a table with primaries and replicas lists:
+//
+//	default = ["user:pass@tcp(10.100.2.2:3306)/loyalty_program"]
+//
+//	[eu]
+//	primaries = ["user:pass@tcp(10.110.2.2:3306)/loyalty_program"]
+//	replicas = ["user:pass@tcp(10.110.3.2:3306)/loyalty_program"]
+func ParseConfig(data []byte) (map[string]Cluster, error) {
+	var raw map[string]interface{}
+	if err := toml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	cfg := make(map[string]Cluster, len(raw))
+	for region, value := range raw {
+		var cluster Cluster
+		var err error
+
+		switch v := value.(type) {
+		case []interface{}:
+			cluster.Primaries, err = uriList(v)
+		case map[string]interface{}:
+			for key, list := range v {
+				uris, ok := list.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("region %q: %s must be a list of servers", region, key)
+				}
+
+				switch key {
+				case "primaries":
+					cluster.Primaries, err = uriList(uris)
+				case "replicas":
+					cluster.Replicas, err = uriList(uris)
+				default:
+					return nil, fmt.Errorf("region %q: unknown setting %q", region, key)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("region %q: %w", region, err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("region %q must be a list of servers or a table of primaries and replicas", region)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("region %q: %w", region, err)
+		}
+
+		cfg[region] = cluster
+	}
+
+	return cfg, nil
+}
+
+func uriList(values []interface{}) ([]string, error) {
+	uris := make([]string, 0, len(values))
+	for _, value := range values {
+		uri, ok := value.(string)
+		if !ok {
+			return nil, errors.New("servers must be connection strings")
+		}
+		uris = append(uris, uri)
+	}
+	return uris, nil
+}
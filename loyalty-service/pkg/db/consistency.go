@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultReadYourWritesWindow is how long after a write reads keep going to the primaries unless
+// configured otherwise. It must be longer than the replicas ever lag behind.
+const DefaultReadYourWritesWindow = 5 * time.Second
+
+type replicaReadsKey struct{}
+
+type lastWriteKey struct{}
+
+// WithReplicaReads returns a copy of ctx whose queries outside of transactions may be answered by
+// a replica, unless the caller wrote to the region too recently, see WithLastWrite.
+func WithReplicaReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicaReadsKey{}, true)
+}
+
+// WithLastWrite returns a copy of ctx that remembers when the caller last wrote to the region, so
+// reads can avoid replicas that may not have caught up with it yet.
+func WithLastWrite(ctx context.Context, at time.Time) context.Context {
+	return context.WithValue(ctx, lastWriteKey{}, at)
+}
+
+// ConsistencyToken encodes the time of a write to a region. Clients hand it back on their next
+// requests to read their own writes, see ParseConsistencyToken.
+func ConsistencyToken(region string, at time.Time) string {
+	return region + ":" + strconv.FormatInt(at.UnixMilli(), 10)
+}
+
+// ParseConsistencyToken decodes a token made by ConsistencyToken.
+func ParseConsistencyToken(token string) (string, time.Time, bool) {
+	i := strings.LastIndex(token, ":")
+	if i <= 0 {
+		return "", time.Time{}, false
+	}
+
+	ms, err := strconv.ParseInt(token[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return token[:i], time.UnixMilli(ms), true
+}
+
+// readsFromReplica reports whether a query made with ctx can go to a replica.
+func readsFromReplica(ctx context.Context, window time.Duration) bool {
+	if allowed, _ := ctx.Value(replicaReadsKey{}).(bool); !allowed {
+		return false
+	}
+
+	if at, ok := ctx.Value(lastWriteKey{}).(time.Time); ok && time.Since(at) < window {
+		return false
+	}
+	return true
+}
@@ -1,37 +1,39 @@
 package db
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"time"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	"gorm.io/plugin/dbresolver"
 )
 
-func Connect(uris []string) (*gorm.DB, error) {
-	db, err := gorm.Open(mysql.Open(uris[0]), &gorm.Config{})
-
+// Connect opens a connection group for every region of the configuration, keyed by region name.
+// Queries go to the cluster of the region their context names, see WithRegion, and reads stay
+// off its replicas for window after the reader's last write. It fails unless a majority of every
+// region's primaries can be reached, see Regions.Probe.
+func Connect(cfg map[string]Cluster, window time.Duration) (*gorm.DB, *Regions, error) {
+	regions, err := NewRegions(cfg, window)
 	if err != nil {
-		log.Fatalf("Failed to connect to MySQL database: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	var sources []gorm.Dialector
-
-	if len(uris) > 1 {
-		for _, uri := range uris[1:] {
-			sources = append(sources, mysql.Open(uri))
-		}
+	// Find out which servers are up before gorm sends its first query
+	if err := regions.Probe(context.Background()); err != nil {
+		regions.Close()
+		return nil, nil, fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
 
-		err = db.Use(dbresolver.Register(dbresolver.Config{
-			Sources: sources,
-		}))
+	// TranslateError turns MySQL error codes into gorm errors such as gorm.ErrDuplicatedKey
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: regions}), &gorm.Config{TranslateError: true, DisableAutomaticPing: true})
 
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		regions.Close()
+		return nil, nil, fmt.Errorf("failed to connect to MySQL: %w", err)
 	}
 
-	log.Println("Connected to MySQL")
-	return db, nil
+	log.Printf("Connected to MySQL in regions %v", regions.Names())
+	return db, regions, nil
 }
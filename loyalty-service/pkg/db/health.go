@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DefaultHealthCheckInterval is how often every server is probed unless configured otherwise.
+const DefaultHealthCheckInterval = 5 * time.Second
+
+// Circuit breaker settings, see node.allow.
+const (
+	breakerThreshold = 3                // consecutive connection failures that open a server's breaker
+	breakerCooldown  = 10 * time.Second // how long an open breaker turns statements away
+	probeTimeout     = 2 * time.Second  // how long a health probe waits for a server to answer
+)
+
+// ErrUnavailable is returned without asking any server when none of a region's servers can take a
+// statement, because they failed their last health check or their circuit breaker is open.
+var ErrUnavailable = errors.New("no database server available")
+
+// node is one MySQL server of a region. Servers that fail a health check are taken out of the
+// region's pool until they pass one again, and servers whose connections keep failing between
+// checks are turned away by their circuit breaker.
+type node struct {
+	*sql.DB
+	addr string // host:port, for logs without the credentials
+
+	healthy int32 // 1 if the last health check passed
+
+	mu        sync.Mutex
+	failures  int       // consecutive connection failures
+	openUntil time.Time // statements fail fast until then
+}
+
+func openNode(uri string) (*node, error) {
+	dsn, err := mysql.ParseDSN(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("mysql", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// Assumed healthy until the first check says otherwise
+	return &node{DB: db, addr: dsn.Addr, healthy: 1}, nil
+}
+
+// allow reports whether a statement may be sent to the server. Once its breaker's cooldown has
+// passed statements are let through again, and the next connection failure opens it at once.
+func (n *node) allow() bool {
+	if atomic.LoadInt32(&n.healthy) == 0 {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return !time.Now().Before(n.openUntil)
+}
+
+// record feeds the outcome of a statement to the server's breaker. Only connection failures
+// count, an SQL error such as a duplicate key says the server is working fine.
+func (n *node) record(err error) {
+	down := isConnectionError(err)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !down {
+		n.failures = 0
+		return
+	}
+
+	n.failures++
+	if n.failures >= breakerThreshold {
+		if !time.Now().Before(n.openUntil) {
+			log.Printf("Database %s failing, turning statements away for %v: %v", n.addr, breakerCooldown, err)
+		}
+		n.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// probe checks that the server answers, taking it out of or putting it back into the pool.
+func (n *node) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	err := n.PingContext(ctx)
+	if err != nil {
+		if atomic.SwapInt32(&n.healthy, 0) == 1 {
+			log.Printf("Database %s is down, taking it out of the pool: %v", n.addr, err)
+		}
+		return err
+	}
+
+	if atomic.SwapInt32(&n.healthy, 1) == 0 {
+		log.Printf("Database %s is back up, readmitting it to the pool", n.addr)
+	}
+	// A server that answers again needn't wait for its breaker to cool down
+	n.mu.Lock()
+	n.failures = 0
+	n.openUntil = time.Time{}
+	n.mu.Unlock()
+	return nil
+}
+
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr)
+}
+
+// Probe checks every server of every region at once, and fails unless a majority of each
+// region's primaries answer. Replicas may all be down, their reads go to the primaries instead.
+func (r *Regions) Probe(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, g := range r.groups {
+		for _, n := range g.nodes() {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				n.probe(ctx)
+			}(n)
+		}
+	}
+	wg.Wait()
+
+	for _, region := range r.Names() {
+		up := 0
+		primaries := r.groups[region].primaries
+		for _, n := range primaries {
+			if atomic.LoadInt32(&n.healthy) == 1 {
+				up++
+			}
+		}
+		if up*2 <= len(primaries) {
+			return fmt.Errorf("region %q: only %d of %d primaries reachable", region, up, len(primaries))
+		}
+	}
+
+	return nil
+}
+
+// Run probes every server at each interval until ctx is cancelled.
+func (r *Regions) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Probe(ctx); err != nil {
+				log.Printf("Database health check: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRegion is the region key every configuration must have. It is home to anything that
+// isn't tied to a region, and to requests that don't say which region they belong to.
+const DefaultRegion = "default"
+
+// maxLocations bounds how many located rows Regions remembers before starting over.
+const maxLocations = 100000
+
+var (
+	// ErrUnknownRegion is returned when a context names a region that isn't configured.
+	ErrUnknownRegion = errors.New("unknown region")
+	// ErrNotLocated is returned when a row can't be found in any region.
+	ErrNotLocated = errors.New("not found in any region")
+)
+
+type regionKey struct{}
+
+// WithRegion returns a copy of ctx whose queries go to the given region's cluster.
+func WithRegion(ctx context.Context, region string) context.Context {
+	return context.WithValue(ctx, regionKey{}, region)
+}
+
+// RegionFrom returns the region a context's queries go to.
+func RegionFrom(ctx context.Context) string {
+	if region, ok := ctx.Value(regionKey{}).(string); ok && region != "" {
+		return region
+	}
+	return DefaultRegion
+}
+
+// group is the connections to one region's MySQL cluster. Every SQL node of an NDB cluster
+// accepts writes, so statements are spread over all of the primaries.
+type group struct {
+	primaries []*node
+	replicas  []*node
+	next      uint32
+}
+
+// pick chooses the next available primary, or the next available replica if read is set and the
+// region has one. Servers that are down or whose breaker is open are skipped.
+func (g *group) pick(read bool) (*node, error) {
+	start := int(atomic.AddUint32(&g.next, 1))
+
+	if read {
+		if n := next(g.replicas, start); n != nil {
+			return n, nil
+		}
+	}
+	if n := next(g.primaries, start); n != nil {
+		return n, nil
+	}
+	return nil, ErrUnavailable
+}
+
+func (g *group) nodes() []*node {
+	return append(append([]*node{}, g.primaries...), g.replicas...)
+}
+
+// next returns the first server from start on, round the list, that may take a statement.
+func next(nodes []*node, start int) *node {
+	for i := range nodes {
+		if n := nodes[(start+i)%len(nodes)]; n.allow() {
+			return n
+		}
+	}
+	return nil
+}
+
+// Regions is a gorm connection pool that sends every statement and transaction to the cluster
+// of the region named by its context, see WithRegion. Contexts without a region use DefaultRegion.
+//
+// Within a region, queries go to a replica if their context allows it, see WithReplicaReads,
+// and everything else to a primary.
+type Regions struct {
+	groups map[string]*group
+	window time.Duration // how long after a write the writer's reads avoid replicas
+
+	mu        sync.Mutex
+	locations map[string]string // cache of Locate results by UUID
+}
+
+// NewRegions opens a connection group for every region of the configuration. For window after a
+// write, reads by the writer stay off the replicas.
+func NewRegions(cfg map[string]Cluster, window time.Duration) (*Regions, error) {
+	if _, ok := cfg[DefaultRegion]; !ok {
+		return nil, fmt.Errorf("the %q region must be configured", DefaultRegion)
+	}
+
+	r := &Regions{
+		groups:    make(map[string]*group, len(cfg)),
+		window:    window,
+		locations: make(map[string]string),
+	}
+
+	for region, cluster := range cfg {
+		if len(cluster.Primaries) == 0 {
+			r.Close()
+			return nil, fmt.Errorf("region %q doesn't list any primaries", region)
+		}
+
+		g := &group{}
+		r.groups[region] = g
+
+		for _, uri := range cluster.Primaries {
+			n, err := openNode(uri)
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("region %q: %w", region, err)
+			}
+			g.primaries = append(g.primaries, n)
+		}
+		for _, uri := range cluster.Replicas {
+			n, err := openNode(uri)
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("region %q: %w", region, err)
+			}
+			g.replicas = append(g.replicas, n)
+		}
+	}
+
+	return r, nil
+}
+
+// RegionsOf builds Regions over databases the caller has opened, one primary per region, e.g. to
+// give tests a region of their own for every database. Closing the Regions closes the databases.
+func RegionsOf(dbs map[string]*sql.DB, window time.Duration) (*Regions, error) {
+	if _, ok := dbs[DefaultRegion]; !ok {
+		return nil, fmt.Errorf("the %q region must be configured", DefaultRegion)
+	}
+
+	r := &Regions{
+		groups:    make(map[string]*group, len(dbs)),
+		window:    window,
+		locations: make(map[string]string),
+	}
+	for region, db := range dbs {
+		r.groups[region] = &group{primaries: []*node{{DB: db, addr: region, healthy: 1}}}
+	}
+
+	return r, nil
+}
+
+// Names lists the configured regions in alphabetical order.
+func (r *Regions) Names() []string {
+	names := make([]string, 0, len(r.groups))
+	for region := range r.groups {
+		names = append(names, region)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether a region is configured.
+func (r *Regions) Has(region string) bool {
+	_, ok := r.groups[region]
+	return ok
+}
+
+// Available reports whether a region has a primary that can take statements.
+func (r *Regions) Available(region string) bool {
+	g, ok := r.groups[region]
+	return ok && next(g.primaries, 0) != nil
+}
+
+// Locate finds the region whose cluster has a row of table with column equal to value.
+// Only primaries are asked, so rows are found as soon as they are written.
+//
+// Rows never move between regions and UUIDs never change, so where a row was found by a *_uuid
+// column is remembered. Other columns, such as an email address, can be changed or taken by
+// someone else in another region, and are looked up every time.
+func (r *Regions) Locate(ctx context.Context, table, column, value string) (string, error) {
+	if len(r.groups) == 1 {
+		return DefaultRegion, nil
+	}
+
+	key := table + "." + column + "=" + value
+	cache := strings.HasSuffix(column, "_uuid")
+	if cache {
+		r.mu.Lock()
+		region, ok := r.locations[key]
+		r.mu.Unlock()
+		if ok {
+			return region, nil
+		}
+	}
+
+	// Table and column names are never user input, only the value is
+	query := fmt.Sprintf("SELECT 1 FROM %s WHERE %s = ? LIMIT 1", table, column)
+	for _, region := range r.Names() {
+		n, err := r.groups[region].pick(false)
+		if err != nil {
+			return "", fmt.Errorf("region %q: %w", region, err)
+		}
+
+		var found int
+		err = n.QueryRowContext(ctx, query, value).Scan(&found)
+		n.record(err)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("region %q: %w", region, err)
+		}
+
+		if cache {
+			r.mu.Lock()
+			if len(r.locations) >= maxLocations {
+				r.locations = make(map[string]string)
+			}
+			r.locations[key] = region
+			r.mu.Unlock()
+		}
+		return region, nil
+	}
+
+	return "", ErrNotLocated
+}
+
+// Ping checks that a majority of every region's primaries can be reached, see Probe.
+func (r *Regions) Ping() error {
+	return r.Probe(context.Background())
+}
+
+// Close closes every connection.
+func (r *Regions) Close() error {
+	var err error
+	for _, g := range r.groups {
+		for _, n := range g.nodes() {
+			if closeErr := n.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// server chooses the server for a statement made with ctx. Only queries, read set, may go to a replica.
+func (r *Regions) server(ctx context.Context, read bool) (*node, error) {
+	region := RegionFrom(ctx)
+	g, ok := r.groups[region]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownRegion, region)
+	}
+
+	n, err := g.pick(read && readsFromReplica(ctx, r.window))
+	if err != nil {
+		return nil, fmt.Errorf("region %q: %w", region, err)
+	}
+	return n, nil
+}
+
+// PrepareContext implements gorm.ConnPool.
+func (r *Regions) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	n, err := r.server(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := n.PrepareContext(ctx, query)
+	n.record(err)
+	return stmt, err
+}
+
+// ExecContext implements gorm.ConnPool.
+func (r *Regions) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	n, err := r.server(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := n.ExecContext(ctx, query, args...)
+	n.record(err)
+	return result, err
+}
+
+// QueryContext implements gorm.ConnPool.
+func (r *Regions) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	n, err := r.server(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := n.QueryContext(ctx, query, args...)
+	n.record(err)
+	return rows, err
+}
+
+// QueryRowContext implements gorm.ConnPool. A context naming an unknown region, or a region with
+// no server available, gets a row that fails with the reason, the query is never sent anywhere.
+// Its outcome isn't known until the row is scanned, so it isn't fed to the server's breaker.
+func (r *Regions) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	n, err := r.server(ctx, true)
+	if err != nil {
+		return refused(ctx, err, query, args...)
+	}
+	return n.QueryRowContext(ctx, query, args...)
+}
+
+// refused returns a row that fails with err when scanned. sql.Row can't be built with an error of
+// its own, so the row comes from a pool whose every connection attempt fails with err.
+func refused(ctx context.Context, err error, query string, args ...interface{}) *sql.Row {
+	pool := sql.OpenDB(refusal{err})
+	defer pool.Close()
+	return pool.QueryRowContext(ctx, query, args...)
+}
+
+// refusal is a driver.Connector that never connects.
+type refusal struct {
+	err error
+}
+
+func (r refusal) Connect(context.Context) (driver.Conn, error) {
+	return nil, r.err
+}
+
+func (r refusal) Driver() driver.Driver {
+	return r
+}
+
+func (r refusal) Open(string) (driver.Conn, error) {
+	return nil, r.err
+}
+
+// BeginTx implements gorm.TxBeginner, the whole transaction runs on one primary of the context's region.
+func (r *Regions) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	n, err := r.server(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := n.BeginTx(ctx, opts)
+	n.record(err)
+	return tx, err
+}
+
+// GetDBConn implements gorm.GetDBConnector, it returns a connection to an available primary of the
+// default region.
+func (r *Regions) GetDBConn() (*sql.DB, error) {
+	g := r.groups[DefaultRegion]
+	if n := next(g.primaries, 0); n != nil {
+		return n.DB, nil
+	}
+	return g.primaries[0].DB, nil
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestQueryRowContextRefusesUnknownRegion(t *testing.T) {
+	r := &Regions{groups: map[string]*group{DefaultRegion: {}}}
+
+	var found int
+	err := r.QueryRowContext(WithRegion(context.Background(), "nowhere"), "SELECT 1").Scan(&found)
+	if !errors.Is(err, ErrUnknownRegion) {
+		t.Errorf("Scan = %v, want %v", err, ErrUnknownRegion)
+	}
+}
+
+func TestQueryRowContextRefusesUnavailableRegion(t *testing.T) {
+	// The region's only primary is down
+	r := &Regions{groups: map[string]*group{DefaultRegion: {primaries: []*node{{}}}}}
+
+	var found int
+	err := r.QueryRowContext(context.Background(), "SELECT 1").Scan(&found)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Scan = %v, want %v", err, ErrUnavailable)
+	}
+}
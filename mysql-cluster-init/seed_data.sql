@@ -1,10 +1,10 @@
 USE loyalty_program;
 
 -- Inserting sample data into Stores
-INSERT INTO stores (store_uuid, name, region) VALUES
-(UUID(), 'Store A', 'North America'),
-(UUID(), 'Store B', 'Europe'),
-(UUID(), 'Store C', 'Europe');
+INSERT INTO stores (store_uuid, name, region, timezone, currency, creation_date) VALUES
+(UUID(), 'Store A', 'North America', 'America/New_York', 'USD', NOW()),
+(UUID(), 'Store B', 'Europe', 'Europe/Dublin', 'EUR', NOW()),
+(UUID(), 'Store C', 'Europe', 'Europe/Dublin', 'EUR', NOW());
 
 
 